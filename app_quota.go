@@ -0,0 +1,310 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "sync"
+import "time"
+import "sync/atomic"
+import "expvar"
+import "strconv"
+
+//通话双方, uid1 < uid2
+type CallKey struct {
+	uid1 int64
+	uid2 int64
+}
+
+func call_key(sender int64, receiver int64) CallKey {
+	if sender < receiver {
+		return CallKey{sender, receiver}
+	}
+	return CallKey{receiver, sender}
+}
+
+//通话开始时加入AppUsage, 发送方的TunnelClient缓存这个指针, 之后的包只原子更新ts
+type AppCall struct {
+	//最后一次转发的时间
+	ts      int64
+	//超时被删除之后置1, 缓存它的客户端重新加入
+	removed int32
+	key     CallKey
+}
+
+func (call *AppCall) Active(key CallKey) bool {
+	return call != nil && call.key == key && atomic.LoadInt32(&call.removed) == 0
+}
+
+//每秒最多写一次
+func (call *AppCall) Touch(now int64) {
+	if atomic.LoadInt64(&call.ts) != now {
+		atomic.StoreInt64(&call.ts, now)
+	}
+}
+
+//一个app在本服务器上的资源使用, 通过/debug/vars的app_quota查看
+//stats中的Func会获取mutex, 持有mutex时不能修改stats
+type AppUsage struct {
+	//当前一秒内转发的字节数, 高32位为时间, 低32位为字节数, 一次CAS同时切换时间和清零
+	//64位原子操作需要放在前面
+	window         uint64
+	//切换时保存的上一个window
+	last_window    uint64
+
+	mutex          sync.Mutex
+	tunnel_clients int
+	turn_allocations int
+	//正在中转的通话
+	calls          map[CallKey]*AppCall
+	stats          *expvar.Map
+}
+
+func NewAppUsage(appid int64) *AppUsage {
+	usage := new(AppUsage)
+	usage.calls = make(map[CallKey]*AppCall)
+	usage.stats = new(expvar.Map).Init()
+	usage.stats.Set("tunnel_clients", expvar.Func(func() interface{} {
+		usage.mutex.Lock()
+		defer usage.mutex.Unlock()
+		return usage.tunnel_clients
+	}))
+	usage.stats.Set("turn_allocations", expvar.Func(func() interface{} {
+		usage.mutex.Lock()
+		defer usage.mutex.Unlock()
+		return usage.turn_allocations
+	}))
+	usage.stats.Set("calls", expvar.Func(func() interface{} {
+		return usage.Calls()
+	}))
+	usage.stats.Set("bandwidth", expvar.Func(func() interface{} {
+		return usage.Bandwidth(time.Now().Unix())
+	}))
+	app_quota_stats.Set(strconv.FormatInt(appid, 10), usage.stats)
+	return usage
+}
+
+//新的用户, max_clients为0时不限制
+func (usage *AppUsage) AddClient(max_clients int) bool {
+	usage.mutex.Lock()
+	ok := max_clients <= 0 || usage.tunnel_clients < max_clients
+	if ok {
+		usage.tunnel_clients++
+	}
+	usage.mutex.Unlock()
+	if !ok {
+		usage.stats.Add("rejected_tunnel_clients", 1)
+	}
+	return ok
+}
+
+func (usage *AppUsage) RemoveClient() {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	usage.tunnel_clients--
+}
+
+//新的TURN分配, max_allocations为0时不限制
+func (usage *AppUsage) AddTURNAllocation(max_allocations int) bool {
+	usage.mutex.Lock()
+	ok := max_allocations <= 0 || usage.turn_allocations < max_allocations
+	if ok {
+		usage.turn_allocations++
+	}
+	usage.mutex.Unlock()
+	if !ok {
+		usage.stats.Add("rejected_turn_allocations", 1)
+	}
+	return ok
+}
+
+func (usage *AppUsage) RemoveTURNAllocation() {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	usage.turn_allocations--
+}
+
+func pack_window(ts uint32, bytes int64) uint64 {
+	return uint64(ts)<<32 | uint64(bytes)
+}
+
+func unpack_window(w uint64) (uint32, int64) {
+	return uint32(w >> 32), int64(w & 0xffffffff)
+}
+
+//上一秒转发的字节数, 没有数据时不会更新window
+func (usage *AppUsage) Bandwidth(now int64) int64 {
+	w := atomic.LoadUint64(&usage.window)
+	if ts, bytes := unpack_window(w); ts == uint32(now - 1) {
+		return bytes
+	} else if ts != uint32(now) {
+		return 0
+	}
+	if ts, bytes := unpack_window(atomic.LoadUint64(&usage.last_window)); ts == uint32(now - 1) {
+		return bytes
+	}
+	return 0
+}
+
+func (usage *AppUsage) Calls() int {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	return len(usage.calls)
+}
+
+//通话数达到max_calls时返回nil, 已有的通话不受影响
+func (usage *AppUsage) StartCall(key CallKey, now int64, max_calls int) *AppCall {
+	usage.mutex.Lock()
+	call, ok := usage.calls[key]
+	if !ok && (max_calls <= 0 || len(usage.calls) < max_calls) {
+		call = &AppCall{ts:now, key:key}
+		usage.calls[key] = call
+	}
+	usage.mutex.Unlock()
+
+	if call == nil {
+		usage.stats.Add("rejected_calls", 1)
+	} else if !ok {
+		usage.stats.Add("calls_started", 1)
+	}
+	return call
+}
+
+//计入当前一秒的字节数, 超过max_bandwidth时丢弃这一秒内剩余的包
+//字节数只有32位, max_bandwidth最大约4GB/秒
+func (usage *AppUsage) AddBytes(n int, now int64, max_bandwidth int64) bool {
+	if max_bandwidth > 0xffffffff {
+		max_bandwidth = 0xffffffff
+	}
+	for {
+		w := atomic.LoadUint64(&usage.window)
+		ts, bytes := unpack_window(w)
+		cur := uint32(now)
+		if w != 0 && int32(cur - ts) < 0 {
+			//其它协程已经切换到了下一秒, 计入当前的window
+			cur = ts
+		}
+		if cur != ts {
+			//切换到新的一秒, 和计数在同一次CAS中完成, 不会丢失并发计入的字节数
+			bytes = 0
+		}
+		ok := bytes + int64(n) <= max_bandwidth
+		if ok {
+			bytes += int64(n)
+		} else if cur == ts {
+			usage.drop(n)
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&usage.window, w, pack_window(cur, bytes)) {
+			if cur != ts {
+				atomic.StoreUint64(&usage.last_window, w)
+			}
+			if !ok {
+				usage.drop(n)
+			}
+			return ok
+		}
+	}
+}
+
+func (usage *AppUsage) drop(n int) {
+	usage.stats.Add("dropped_packets", 1)
+	usage.stats.Add("dropped_bytes", int64(n))
+}
+
+//删除超过timeout秒没有数据的通话
+func (usage *AppUsage) ExpireCalls(now int64, timeout int64) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	for key, call := range usage.calls {
+		if now - atomic.LoadInt64(&call.ts) > timeout {
+			atomic.StoreInt32(&call.removed, 1)
+			delete(usage.calls, key)
+		}
+	}
+}
+
+//返回超过的配额, 0表示可以转发
+//没有配置通话数和带宽的配额时不统计, 转发时只读取一次配置
+func (tunnel *Tunnel) check_quota(client *TunnelClient, receiver int64, n int, now int64) uint8 {
+	cfg := GetConfig()
+	if !cfg.forward_quota {
+		return 0
+	}
+	max_calls, _, max_bandwidth := cfg.AppQuota(client.appid)
+	if max_calls > 0 {
+		key := call_key(client.uid, receiver)
+		call, _ := client.call.Load().(*AppCall)
+		if !call.Active(key) {
+			call = client.usage.StartCall(key, now, max_calls)
+			if call == nil {
+				return QUOTA_CALLS
+			}
+			client.call.Store(call)
+		}
+		call.Touch(now)
+	}
+	if max_bandwidth > 0 && !client.usage.AddBytes(n, now, max_bandwidth) {
+		return QUOTA_BANDWIDTH
+	}
+	return 0
+}
+
+type AppQuotas struct {
+	mutex sync.RWMutex
+	apps  map[int64]*AppUsage
+}
+
+func NewAppQuotas() *AppQuotas {
+	quotas := new(AppQuotas)
+	quotas.apps = make(map[int64]*AppUsage)
+	return quotas
+}
+
+//app的记录不删除, appid的数量有限
+func (quotas *AppQuotas) Get(appid int64) *AppUsage {
+	quotas.mutex.RLock()
+	usage, ok := quotas.apps[appid]
+	quotas.mutex.RUnlock()
+	if ok {
+		return usage
+	}
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+	if usage, ok := quotas.apps[appid]; ok {
+		return usage
+	}
+	usage = NewAppUsage(appid)
+	quotas.apps[appid] = usage
+	return usage
+}
+
+func (quotas *AppQuotas) ExpireCalls(now int64) {
+	quotas.mutex.RLock()
+	apps := make(map[int64]*AppUsage, len(quotas.apps))
+	for appid, usage := range quotas.apps {
+		apps[appid] = usage
+	}
+	quotas.mutex.RUnlock()
+
+	cfg := GetConfig()
+	for appid, usage := range apps {
+		usage.ExpireCalls(now, int64(cfg.GetAppConfig(appid).voip_client_timeout))
+	}
+}
@@ -0,0 +1,183 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "sync"
+import "time"
+import "testing"
+
+func TestAppUsageCalls(t *testing.T) {
+	usage := NewAppUsage(1001)
+	now := int64(1000)
+	c1 := usage.StartCall(call_key(1, 2), now, 1)
+	if c1 == nil {
+		t.Fatal("first call rejected")
+	}
+	//反方向是同一个通话
+	if c := usage.StartCall(call_key(2, 1), now, 1); c != c1 {
+		t.Error("same call counted twice")
+	}
+	if c := usage.StartCall(call_key(1, 3), now, 1); c != nil {
+		t.Error("max_calls exceeded")
+	}
+
+	c1.Touch(now + 5)
+	usage.ExpireCalls(now + 10, 10)
+	if usage.Calls() != 1 || !c1.Active(call_key(1, 2)) {
+		t.Fatal("active call expired")
+	}
+	usage.ExpireCalls(now + 16, 10)
+	if usage.Calls() != 0 || c1.Active(call_key(1, 2)) {
+		t.Fatal("idle call not expired")
+	}
+	if c := usage.StartCall(call_key(1, 3), now + 16, 1); c == nil {
+		t.Error("call rejected after expiry")
+	}
+}
+
+func TestAppUsageBandwidth(t *testing.T) {
+	usage := NewAppUsage(1002)
+	now := int64(1000)
+	if !usage.AddBytes(600, now, 1000) {
+		t.Fatal("under max_bandwidth dropped")
+	}
+	if usage.AddBytes(600, now, 1000) {
+		t.Error("over max_bandwidth forwarded")
+	}
+	if !usage.AddBytes(400, now, 1000) {
+		t.Error("dropped bytes counted")
+	}
+	if !usage.AddBytes(600, now + 1, 1000) {
+		t.Error("new window dropped")
+	}
+	if b := usage.Bandwidth(now + 1); b != 1000 {
+		t.Errorf("bandwidth:%d", b)
+	}
+	if b := usage.Bandwidth(now + 3); b != 0 {
+		t.Errorf("idle bandwidth:%d", b)
+	}
+}
+
+//多个协程同时跨过一秒的边界, 切换window时不丢失并发计入的字节数
+func TestAppUsageBandwidthWindow(t *testing.T) {
+	usage := NewAppUsage(1005)
+	const workers = 8
+	const packets = 10000
+	wg := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				now := int64(1000)
+				if j >= packets/2 {
+					now = 1001
+				}
+				if !usage.AddBytes(1, now, 1 << 30) {
+					t.Error("under max_bandwidth dropped")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	//1000的window切换时保存, 1001的window是当前的
+	total := usage.Bandwidth(1001) + usage.Bandwidth(1002)
+	if total != workers*packets {
+		t.Errorf("counted bytes:%d sent:%d", total, workers*packets)
+	}
+}
+
+//分配数达到上限时拒绝, 删除之后可以重新分配
+func TestAppUsageTURNAllocations(t *testing.T) {
+	usage := NewAppUsage(1004)
+	if !usage.AddTURNAllocation(2) || !usage.AddTURNAllocation(2) {
+		t.Fatal("under max_allocations rejected")
+	}
+	if usage.AddTURNAllocation(2) {
+		t.Error("max_allocations exceeded")
+	}
+	usage.RemoveTURNAllocation()
+	if !usage.AddTURNAllocation(2) {
+		t.Error("allocation rejected after remove")
+	}
+	if !usage.AddTURNAllocation(0) {
+		t.Error("unlimited allocation rejected")
+	}
+}
+
+//转发, 新的通话和清理同时进行, 使用go test -race检查
+func TestAppUsageRace(t *testing.T) {
+	usage := NewAppUsage(1003)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(sender int64) {
+			defer wg.Done()
+			var call *AppCall
+			for j := 0; j < 10000; j++ {
+				now := int64(1000 + j/100)
+				key := call_key(sender, int64(j%8))
+				if !call.Active(key) {
+					call = usage.StartCall(key, now, 16)
+				}
+				if call != nil {
+					call.Touch(now)
+				}
+				usage.AddBytes(100, now, 1 << 20)
+			}
+		}(int64(i))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 1000; j++ {
+			usage.ExpireCalls(int64(1000 + j/10), 0)
+			usage.Bandwidth(int64(1000 + j/10))
+		}
+	}()
+	wg.Wait()
+}
+
+//同一个地址不断更换token, 被替换的用户释放tunnel客户端数, 不会一直占满配额
+func TestAppQuotaTokenSwitch(t *testing.T) {
+	tunnel := NewTunnel()
+	addr := &net.UDPAddr{IP:net.IPv4(10, 0, 0, 2), Port:40000}
+	now := time.Now().Unix()
+	for uid := int64(1); uid <= 4; uid++ {
+		client := NewTunnelClient(addr)
+		client.appid, client.uid, client.has_header = 7, uid, true
+		client.Touch(now)
+		if !tunnel.add_tunnel_client(client, 1) {
+			t.Fatalf("uid:%d rejected", uid)
+		}
+	}
+	usage := tunnel.quotas.Get(7)
+	if usage.tunnel_clients != 1 {
+		t.Fatalf("tunnel_clients:%d", usage.tunnel_clients)
+	}
+
+	timeout := int64(GetConfig().voip_client_timeout)
+	tunnel.collect(now + timeout + 1)
+	if usage.tunnel_clients != 0 {
+		t.Errorf("tunnel_clients:%d after gc", usage.tunnel_clients)
+	}
+}
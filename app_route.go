@@ -90,3 +90,13 @@ func (set ClientSet) Clone() ClientSet {
 	}
 	return n
 }
+
+func (app_route *AppRoute) GetRoutes() []*Route {
+	app_route.mutex.Lock()
+	defer app_route.mutex.Unlock()
+	routes := make([]*Route, 0, len(app_route.apps))
+	for _, route := range app_route.apps {
+		routes = append(routes, route)
+	}
+	return routes
+}
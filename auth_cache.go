@@ -0,0 +1,180 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "sync"
+import "time"
+import "container/list"
+import "github.com/garyburd/redigo/redis"
+import log "github.com/golang/glog"
+
+type AuthCacheEntry struct {
+	token    string
+	appid    int64
+	uid      int64
+	uname    string
+	//token不存在或者已经过期
+	err      error
+	expire   time.Time
+}
+
+//token -> (appid, uid, uname)的lru缓存, 重连风暴时减少redis的访问
+type AuthCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+var auth_cache *AuthCache
+
+func NewAuthCache(capacity int) *AuthCache {
+	cache := new(AuthCache)
+	cache.capacity = capacity
+	cache.entries = make(map[string]*list.Element)
+	cache.lru = list.New()
+	return cache
+}
+
+func (cache *AuthCache) Get(token string) *AuthCacheEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	e, ok := cache.entries[token]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*AuthCacheEntry)
+	if time.Now().After(entry.expire) {
+		cache.lru.Remove(e)
+		delete(cache.entries, token)
+		return nil
+	}
+	cache.lru.MoveToFront(e)
+	return entry
+}
+
+func (cache *AuthCache) Add(entry *AuthCacheEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if e, ok := cache.entries[entry.token]; ok {
+		e.Value = entry
+		cache.lru.MoveToFront(e)
+		return
+	}
+	cache.entries[entry.token] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.capacity {
+		e := cache.lru.Back()
+		cache.lru.Remove(e)
+		delete(cache.entries, e.Value.(*AuthCacheEntry).token)
+	}
+}
+
+func (cache *AuthCache) Remove(token string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if e, ok := cache.entries[token]; ok {
+		cache.lru.Remove(e)
+		delete(cache.entries, token)
+	}
+}
+
+func (cache *AuthCache) Clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+}
+
+//先查本地缓存, token不存在的结果也缓存一段时间
+func LoadUserAccessTokenCached(token string) (int64, int64, string, error) {
+	if auth_cache == nil {
+		return LoadUserAccessToken(token)
+	}
+
+	if entry := auth_cache.Get(token); entry != nil {
+		if entry.err != nil {
+			auth_cache_stats.Add("negative_hit", 1)
+			return 0, 0, "", entry.err
+		}
+		auth_cache_stats.Add("hit", 1)
+		return entry.appid, entry.uid, entry.uname, nil
+	}
+	auth_cache_stats.Add("miss", 1)
+
+	cfg := GetConfig()
+	appid, uid, uname, expires, err := load_user_access_token(token)
+	now := time.Now()
+	if err == ErrTokenNonExists || err == ErrTokenExpired {
+		if cfg.auth_cache_negative_ttl > 0 {
+			ttl := time.Duration(cfg.auth_cache_negative_ttl) * time.Second
+			auth_cache.Add(&AuthCacheEntry{token:token, err:err, expire:now.Add(ttl)})
+		}
+		return 0, 0, "", err
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+
+	expire := now.Add(time.Duration(cfg.auth_cache_ttl) * time.Second)
+	//token在缓存过期之前失效时, 缓存到token的过期时间为止
+	if expires > 0 && time.Unix(expires, 0).Before(expire) {
+		expire = time.Unix(expires, 0)
+	}
+	if expire.After(now) {
+		auth_cache.Add(&AuthCacheEntry{token:token, appid:appid, uid:uid, uname:uname, expire:expire})
+	}
+	return appid, uid, uname, nil
+}
+
+//token被注销时由业务服务器publish到此频道, 消息内容为token, 空消息清空缓存
+func (cache *AuthCache) ListenRevocation(channel string) {
+	for {
+		conn, err := redis_store.PubSubConn()
+		if err != nil {
+			log.Warning("auth cache subscribe err:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		psc := redis.PubSubConn{Conn:conn}
+		psc.Subscribe(channel)
+		for {
+			v := psc.Receive()
+			if m, ok := v.(redis.Message); ok {
+				auth_cache_stats.Add("revoked", 1)
+				if len(m.Data) == 0 {
+					cache.Clear()
+				} else {
+					cache.Remove(string(m.Data))
+				}
+			} else if s, ok := v.(redis.Subscription); ok {
+				log.Infof("auth cache %s channel:%s", s.Kind, s.Channel)
+			} else if e, ok := v.(error); ok {
+				log.Warning("auth cache receive err:", e)
+				break
+			}
+		}
+		conn.Close()
+		//断开期间可能错过注销消息
+		cache.Clear()
+		time.Sleep(time.Second)
+	}
+}
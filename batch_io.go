@@ -0,0 +1,119 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "golang.org/x/net/ipv4"
+import log "github.com/golang/glog"
+
+//tunnel的处理函数通过它回复, *net.UDPConn和BatchWriter都实现了此接口
+type PacketWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+//收集一次批量读取产生的所有回复, 通过sendmmsg一起发送
+//不复制数据, 调用者需要保证Flush之前数据不被修改(读缓冲区在Flush之后才会重用)
+type BatchWriter struct {
+	conn *net.UDPConn
+	pc   *ipv4.PacketConn
+	msgs []ipv4.Message
+	n    int
+}
+
+func NewBatchWriter(conn *net.UDPConn, size int) *BatchWriter {
+	w := new(BatchWriter)
+	w.conn = conn
+	w.pc = ipv4.NewPacketConn(conn)
+	w.msgs = make([]ipv4.Message, size)
+	for i := range w.msgs {
+		w.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return w
+}
+
+func (w *BatchWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if w.n == len(w.msgs) {
+		w.Flush()
+	}
+	w.msgs[w.n].Buffers[0] = b
+	w.msgs[w.n].Addr = addr
+	w.n++
+	return len(b), nil
+}
+
+func (w *BatchWriter) Flush() {
+	msgs := w.msgs[:w.n]
+	for len(msgs) > 0 {
+		n, err := w.pc.WriteBatch(msgs, 0)
+		if err != nil {
+			//跳过发送失败的包
+			log.Warning("write batch err:", err)
+			batch_io_stats.Add("write_errors", 1)
+			n = 1
+		}
+		batch_io_stats.Add("write_batches", 1)
+		msgs = msgs[n:]
+	}
+	for i := 0; i < w.n; i++ {
+		w.msgs[i].Buffers[0] = nil
+		w.msgs[i].Addr = nil
+	}
+	w.n = 0
+}
+
+//异步回复时(例如worker协程)需要直接使用socket
+func Unbatched(conn PacketWriter) PacketWriter {
+	if w, ok := conn.(*BatchWriter); ok {
+		return w.conn
+	}
+	return conn
+}
+
+//通过recvmmsg一次读取多个包, 所有包处理完之后批量发送回复
+func (tunnel *Tunnel) RunBatch(conn *net.UDPConn, size int) {
+	reader, err := NewBatchReader(conn, size)
+	if err != nil {
+		log.Fatal("batch reader err:", err)
+	}
+	writer := NewBatchWriter(conn, size)
+
+	for {
+		n, err := reader.Read()
+		if err != nil {
+			if reader_gate.IsPaused() {
+				reader_gate.Wait()
+				continue
+			}
+			log.Warning("read batch err:", err)
+			continue
+		}
+		batch_io_stats.Add("read_batches", 1)
+		batch_io_stats.Add("packets", int64(n))
+
+		for i := 0; i < n; i++ {
+			buff, ap := reader.Packet(i)
+			if !ap.IsValid() {
+				continue
+			}
+			tunnel.HandlePacket(buff, ap, writer)
+		}
+		writer.Flush()
+	}
+}
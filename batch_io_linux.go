@@ -0,0 +1,113 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "syscall"
+import "unsafe"
+import "net/netip"
+import "golang.org/x/sys/unix"
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+//直接调用recvmmsg, 对端地址解析为netip.AddrPort,
+//golang.org/x/net的ReadBatch每个包会分配一个UDPAddr
+type BatchReader struct {
+	rc      syscall.RawConn
+	hs      []mmsghdr
+	iovs    []unix.Iovec
+	names   []unix.RawSockaddrInet6
+	buffs   [][]byte
+	n       int
+	errno   syscall.Errno
+	//创建一次, 每次读取时不再分配闭包
+	read_fn func(fd uintptr) bool
+}
+
+func NewBatchReader(conn *net.UDPConn, size int) (*BatchReader, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	r := new(BatchReader)
+	r.rc = rc
+	r.hs = make([]mmsghdr, size)
+	r.iovs = make([]unix.Iovec, size)
+	r.names = make([]unix.RawSockaddrInet6, size)
+	r.buffs = make([][]byte, size)
+	for i := range r.hs {
+		r.buffs[i] = make([]byte, 64*1024)
+		r.iovs[i].Base = &r.buffs[i][0]
+		r.iovs[i].SetLen(len(r.buffs[i]))
+		r.hs[i].hdr.Iov = &r.iovs[i]
+		r.hs[i].hdr.SetIovlen(1)
+		r.hs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+	}
+	r.read_fn = r.recvmmsg
+	return r, nil
+}
+
+func (r *BatchReader) recvmmsg(fd uintptr) bool {
+	for i := range r.hs {
+		r.hs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hs[0])),
+		uintptr(len(r.hs)), 0, 0, 0)
+	if errno == unix.EAGAIN {
+		//等待socket可读, 读超时由RawConn处理
+		return false
+	}
+	r.n = int(n)
+	r.errno = errno
+	return true
+}
+
+//阻塞直到至少读到一个包, 返回包的数量
+func (r *BatchReader) Read() (int, error) {
+	err := r.rc.Read(r.read_fn)
+	if err != nil {
+		return 0, err
+	}
+	if r.errno != 0 {
+		return 0, r.errno
+	}
+	return r.n, nil
+}
+
+//第i个包的内容和对端地址, 下一次Read之前有效
+func (r *BatchReader) Packet(i int) ([]byte, netip.AddrPort) {
+	h := &r.hs[i]
+	name := &r.names[i]
+	//端口为网络字节序
+	p := (*[2]byte)(unsafe.Pointer(&name.Port))
+	port := uint16(p[0])<<8 | uint16(p[1])
+	var addr netip.Addr
+	if name.Family == unix.AF_INET {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		addr = netip.AddrFrom4(sa.Addr)
+	} else {
+		//没有处理链路本地地址的zone, 公网的客户端不会使用
+		addr = netip.AddrFrom16(name.Addr)
+	}
+	return r.buffs[i][:h.len], netip.AddrPortFrom(addr, port)
+}
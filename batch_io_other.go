@@ -0,0 +1,54 @@
+//go:build !linux
+
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "net/netip"
+import "golang.org/x/net/ipv4"
+
+//其它平台使用golang.org/x/net的ReadBatch, 每个包会分配一个UDPAddr
+type BatchReader struct {
+	pc   *ipv4.PacketConn
+	msgs []ipv4.Message
+}
+
+func NewBatchReader(conn *net.UDPConn, size int) (*BatchReader, error) {
+	r := new(BatchReader)
+	r.pc = ipv4.NewPacketConn(conn)
+	r.msgs = make([]ipv4.Message, size)
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, 64*1024)}
+	}
+	return r, nil
+}
+
+func (r *BatchReader) Read() (int, error) {
+	return r.pc.ReadBatch(r.msgs, 0)
+}
+
+func (r *BatchReader) Packet(i int) ([]byte, netip.AddrPort) {
+	var ap netip.AddrPort
+	if raddr, ok := r.msgs[i].Addr.(*net.UDPAddr); ok {
+		ap = raddr.AddrPort()
+	}
+	return r.msgs[i].Buffers[0][:r.msgs[i].N], ap
+}
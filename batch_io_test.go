@@ -0,0 +1,150 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "time"
+import "bytes"
+import "testing"
+import "net/netip"
+
+func listen_test_udp(t testing.TB, addr string) *net.UDPConn {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Skip("listen udp:", err)
+	}
+	//丢包时不会一直阻塞
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	return conn
+}
+
+//读到的对端地址和udp tunnel查找客户端使用的key一致
+func TestBatchReaderAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", ":0", "[::1]:0"} {
+		conn := listen_test_udp(t, addr)
+		defer conn.Close()
+		reader, err := NewBatchReader(conn, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raddr := &net.UDPAddr{IP:net.IPv4(127, 0, 0, 1), Port:conn.LocalAddr().(*net.UDPAddr).Port}
+		if addr == "[::1]:0" {
+			raddr.IP = net.IPv6loopback
+		}
+		sender := listen_test_udp(t, net.JoinHostPort(raddr.IP.String(), "0"))
+		defer sender.Close()
+
+		pkt := voip_data_packet(100, 200, 16)
+		if _, err := sender.WriteToUDP(pkt, raddr); err != nil {
+			t.Fatal(err)
+		}
+		n, err := reader.Read()
+		if err != nil || n != 1 {
+			t.Fatalf("%s read n:%d err:%v", addr, n, err)
+		}
+		buff, ap := reader.Packet(0)
+		if !bytes.Equal(buff, pkt) {
+			t.Errorf("%s packet mismatch", addr)
+		}
+		saddr := sender.LocalAddr().(*net.UDPAddr)
+		if addr_port_key(ap) != addr_key(saddr) {
+			t.Errorf("%s addr:%s, sender:%s", addr, ap, saddr)
+		}
+	}
+}
+
+//RunBatch的处理过程: recvmmsg读取, 按照地址查找客户端, 转发, sendmmsg发送
+type batch_forward struct {
+	tunnel *Tunnel
+	sender *net.UDPConn
+	raddr  netip.AddrPort
+	reader *BatchReader
+	writer *BatchWriter
+	pkt    []byte
+	size   int
+}
+
+func new_batch_forward(t testing.TB, size int) *batch_forward {
+	conn := listen_test_udp(t, "127.0.0.1:0")
+	sender := listen_test_udp(t, "127.0.0.1:0")
+	receiver := listen_test_udp(t, "127.0.0.1:0")
+	t.Cleanup(func() {
+		conn.Close()
+		sender.Close()
+		receiver.Close()
+	})
+
+	f := &batch_forward{size:size, sender:sender}
+	f.tunnel = NewTunnel()
+	add_test_client(f.tunnel, sender.LocalAddr().(*net.UDPAddr).AddrPort(), 7, 100)
+	add_test_client(f.tunnel, receiver.LocalAddr().(*net.UDPAddr).AddrPort(), 7, 200)
+	f.raddr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	reader, err := NewBatchReader(conn, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.reader = reader
+	f.writer = NewBatchWriter(conn, size)
+	f.pkt = voip_data_packet(100, 200, 160)
+	return f
+}
+
+//发送size个包, 然后按照RunBatch的方式读取和转发
+func (f *batch_forward) run() {
+	for i := 0; i < f.size; i++ {
+		f.sender.WriteToUDPAddrPort(f.pkt, f.raddr)
+	}
+	for count := 0; count < f.size; {
+		n, err := f.reader.Read()
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			buff, ap := f.reader.Packet(i)
+			f.tunnel.HandlePacket(buff, ap, f.writer)
+		}
+		f.writer.Flush()
+		count += n
+	}
+}
+
+func TestBatchForwardAllocs(t *testing.T) {
+	if race_enabled {
+		t.Skip("race detector enabled")
+	}
+	f := new_batch_forward(t, 8)
+	if n := testing.AllocsPerRun(100, f.run); n > 0 {
+		t.Errorf("batch forward allocs:%v per %d packets", n, f.size)
+	}
+}
+
+func BenchmarkBatchForward(b *testing.B) {
+	f := new_batch_forward(b, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.run()
+	}
+}
@@ -0,0 +1,190 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+//tunnel压力测试, 统计每秒收到的包数
+//ping模式: 每个socket发送VOIP_PING, 接收VOIP_PONG, 不需要认证
+//data模式: 客户端两两通话, 通过tunnel转发VOIP_DATA, 需要有效的token
+//    tunnel_bench -mode data -tokens uid1:token1,uid2:token2,...
+package main
+
+import "os"
+import "fmt"
+import "net"
+import "flag"
+import "time"
+import "strings"
+import "strconv"
+import "sync/atomic"
+import "encoding/binary"
+import "golang.org/x/net/ipv4"
+
+const VOIP_AUTH = 1
+const VOIP_DATA = 3
+const VOIP_PING = 4
+
+var addr = flag.String("addr", "127.0.0.1:20001", "tunnel address")
+var mode = flag.String("mode", "ping", "ping or data")
+var clients = flag.Int("clients", 8, "number of sockets in ping mode")
+var tokens = flag.String("tokens", "", "uid:token list in data mode")
+var window = flag.Int("window", 32, "packets in flight per socket")
+var size = flag.Int("size", 160, "payload size")
+var duration = flag.Duration("duration", 10*time.Second, "test duration")
+
+var received int64
+
+type BenchClient struct {
+	uid   int64
+	token string
+	peer  int64
+	conn  *net.UDPConn
+}
+
+func auth_packet(token string) []byte {
+	b := make([]byte, 3+len(token))
+	b[0] = VOIP_AUTH
+	binary.BigEndian.PutUint16(b[1:], uint16(len(token)))
+	copy(b[3:], token)
+	return b
+}
+
+func (c *BenchClient) packet() []byte {
+	if *mode == "ping" {
+		return append([]byte{VOIP_PING}, make([]byte, *size)...)
+	}
+	b := make([]byte, 17+*size)
+	b[0] = VOIP_DATA
+	binary.BigEndian.PutUint64(b[1:], uint64(c.uid))
+	binary.BigEndian.PutUint64(b[9:], uint64(c.peer))
+	return b
+}
+
+//tunnel第二次收到相同的token时回复认证成功
+func (c *BenchClient) Auth(raddr *net.UDPAddr) error {
+	buf := make([]byte, 64)
+	for i := 0; i < 10; i++ {
+		c.conn.WriteTo(auth_packet(c.token), raddr)
+		c.conn.SetReadDeadline(time.Now().Add(200*time.Millisecond))
+		n, _, err := c.conn.ReadFrom(buf)
+		if err == nil && n == 2 && buf[1] == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("auth uid:%d failed", c.uid)
+}
+
+//每次发送window个包, 等待收到回复或者超时再发送下一批
+func (c *BenchClient) Run(raddr *net.UDPAddr) {
+	pc := ipv4.NewPacketConn(c.conn)
+	pkt := c.packet()
+	out := make([]ipv4.Message, *window)
+	for i := range out {
+		out[i] = ipv4.Message{Buffers:[][]byte{pkt}, Addr:raddr}
+	}
+	in := make([]ipv4.Message, *window)
+	for i := range in {
+		in[i].Buffers = [][]byte{make([]byte, 2048)}
+	}
+	for {
+		pc.WriteBatch(out, 0)
+		c.conn.SetReadDeadline(time.Now().Add(20*time.Millisecond))
+		got := 0
+		for got < len(out) {
+			n, err := pc.ReadBatch(in, 0)
+			if err != nil {
+				break
+			}
+			got += n
+		}
+		atomic.AddInt64(&received, int64(got))
+	}
+}
+
+func parse_tokens(s string) ([]*BenchClient, error) {
+	result := make([]*BenchClient, 0)
+	for _, item := range strings.Split(s, ",") {
+		pair := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid token:%s", item)
+		}
+		uid, err := strconv.ParseInt(pair[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid:%s", pair[0])
+		}
+		result = append(result, &BenchClient{uid:uid, token:pair[1]})
+	}
+	if len(result) % 2 != 0 {
+		return nil, fmt.Errorf("data mode needs pairs of tokens")
+	}
+	//相邻的两个客户端通话
+	for i := 0; i < len(result); i += 2 {
+		result[i].peer = result[i+1].uid
+		result[i+1].peer = result[i].uid
+	}
+	return result, nil
+}
+
+func main() {
+	flag.Parse()
+	raddr, err := net.ResolveUDPAddr("udp", *addr)
+	if err != nil {
+		fmt.Println("invalid addr:", err)
+		os.Exit(1)
+	}
+
+	var bench_clients []*BenchClient
+	if *mode == "data" {
+		bench_clients, err = parse_tokens(*tokens)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		for i := 0; i < *clients; i++ {
+			bench_clients = append(bench_clients, &BenchClient{})
+		}
+	}
+
+	for _, c := range bench_clients {
+		c.conn, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			fmt.Println("listen udp err:", err)
+			os.Exit(1)
+		}
+		c.conn.SetReadBuffer(4*1024*1024)
+		if *mode == "data" {
+			if err := c.Auth(raddr); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+	for _, c := range bench_clients {
+		go c.Run(raddr)
+	}
+
+	//跳过第一秒的预热
+	time.Sleep(time.Second)
+	begin := atomic.LoadInt64(&received)
+	start := time.Now()
+	time.Sleep(*duration)
+	count := atomic.LoadInt64(&received) - begin
+	elapsed := time.Since(start).Seconds()
+	fmt.Printf("mode:%s sockets:%d packets:%d %.0f pkt/s\n", *mode, len(bench_clients),
+		count, float64(count)/elapsed)
+}
@@ -0,0 +1,149 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "sync"
+import "time"
+import "errors"
+import "github.com/garyburd/redigo/redis"
+import log "github.com/golang/glog"
+
+const BREAKER_CLOSED = 0
+const BREAKER_OPEN = 1
+const BREAKER_HALF_OPEN = 2
+
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+//连续失败max_failures次后断开, cooldown之后允许一个请求试探
+type CircuitBreaker struct {
+	mutex        sync.Mutex
+	name         string
+	state        int
+	failures     int
+	opened_at    time.Time
+	trial        bool
+	max_failures int
+	cooldown     time.Duration
+}
+
+func NewCircuitBreaker(name string, max_failures int, cooldown time.Duration) *CircuitBreaker {
+	b := new(CircuitBreaker)
+	b.name = name
+	b.max_failures = max_failures
+	b.cooldown = cooldown
+	return b
+}
+
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state != BREAKER_CLOSED
+}
+
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.opened_at) < b.cooldown {
+			return false
+		}
+		b.state = BREAKER_HALF_OPEN
+		b.trial = true
+		log.Infof("%s breaker half open", b.name)
+		return true
+	case BREAKER_HALF_OPEN:
+		//同一时间只允许一个试探请求
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	if b.state != BREAKER_CLOSED {
+		log.Infof("%s breaker closed", b.name)
+		breaker_stats.Add(b.name+"_closed", 1)
+	}
+	b.state = BREAKER_CLOSED
+	b.trial = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	breaker_stats.Add(b.name+"_failures", 1)
+	if b.state == BREAKER_HALF_OPEN || b.failures >= b.max_failures {
+		if b.state != BREAKER_OPEN {
+			log.Warningf("%s breaker open, failures:%d", b.name, b.failures)
+			breaker_stats.Add(b.name+"_opened", 1)
+		}
+		b.state = BREAKER_OPEN
+		b.opened_at = time.Now()
+		b.trial = false
+	}
+}
+
+//redis熔断, 断开时所有请求立即返回ErrRedisUnavailable
+type BreakerStore struct {
+	store   RedisStore
+	breaker *CircuitBreaker
+}
+
+var redis_breaker *CircuitBreaker
+
+func NewBreakerStore(store RedisStore, breaker *CircuitBreaker) *BreakerStore {
+	return &BreakerStore{store:store, breaker:breaker}
+}
+
+func (s *BreakerStore) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if !s.breaker.Allow() {
+		breaker_stats.Add(s.breaker.name+"_rejected", 1)
+		return nil, ErrRedisUnavailable
+	}
+	reply, err := s.store.Do(cmd, args...)
+	if _, ok := err.(redis.Error); err != nil && !ok {
+		//redis返回的错误不代表redis不可用
+		s.breaker.Failure()
+	} else {
+		s.breaker.Success()
+	}
+	return reply, err
+}
+
+func (s *BreakerStore) PubSubConn() (redis.Conn, error) {
+	return s.store.PubSubConn()
+}
+
+//redis不可用时已经认证的客户端继续转发, 新的认证立即失败
+func IsDegraded() bool {
+	return redis_breaker != nil && redis_breaker.IsOpen()
+}
@@ -27,31 +27,61 @@ import "encoding/binary"
 import "encoding/json"
 import log "github.com/golang/glog"
 
+//默认值, 可以通过配置文件修改
 const CLIENT_TIMEOUT = (60 * 10)
 
+//发送队列满时的处理策略
+const OVERFLOW_DROP_NEWEST = 0
+const OVERFLOW_DROP_OLDEST = 1
+const OVERFLOW_DISCONNECT = 2
+
 type Client struct {
 	tm     time.Time
 	wt     chan *Message
+	//读协程退出时关闭, 通知写协程
+	closed chan struct{}
 	uid    int64
 	appid  int64
 	device_id string
 	platform_id int8
 	conn   *net.TCPConn
+	//协议版本, 版本1的MSG_AUTH_STATUS包含所有的中转地址
+	version int
 	public_ip int32
+	relay_addrs []*net.UDPAddr
 }
 
 func NewClient(conn *net.TCPConn) *Client {
 	client := new(Client)
 	client.conn = conn
-	client.wt = make(chan *Message, 10)
-	addr := conn.LocalAddr()
-	if taddr, ok := addr.(*net.TCPAddr); ok {
-		ip4 := taddr.IP.To4()
-		client.public_ip = int32(ip4[0]) << 24 | int32(ip4[1]) << 16 | int32(ip4[2]) << 8 | int32(ip4[3])
+	client.wt = make(chan *Message, GetConfig().write_queue_size)
+	client.closed = make(chan struct{})
+	client.relay_addrs = RelayAddresses(conn)
+	for _, addr := range client.relay_addrs {
+		//旧版本的协议只能携带一个ipv4地址
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			client.public_ip = int32(ip4[0]) << 24 | int32(ip4[1]) << 16 | int32(ip4[2]) << 8 | int32(ip4[3])
+			break
+		}
 	}
 	return client
 }
 
+//优先使用配置的公网地址, 否则使用本机地址(在负载均衡或者nat之后时不正确)
+func RelayAddresses(conn *net.TCPConn) []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0)
+	if len(config.tunnel_advertised_ips) > 0 {
+		for _, ip := range config.tunnel_advertised_ips {
+			addrs = append(addrs, &net.UDPAddr{IP:ip, Port:config.tunnel_port_v2})
+		}
+		return addrs
+	}
+	if taddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && !taddr.IP.IsUnspecified() {
+		addrs = append(addrs, &net.UDPAddr{IP:taddr.IP, Port:config.tunnel_port_v2})
+	}
+	return addrs
+}
+
 func (client *Client) RemoveClient() {
 	route := app_route.FindRoute(client.appid)
 	if route == nil {
@@ -64,10 +94,11 @@ func (client *Client) RemoveClient() {
 
 func (client *Client) Read() {
 	for {
-		client.conn.SetDeadline(time.Now().Add(CLIENT_TIMEOUT * time.Second))
+		timeout := GetConfig().GetAppConfig(client.appid).client_timeout
+		client.conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 		msg := ReceiveMessage(client.conn)
 		if msg == nil {
-			client.wt <- nil
+			close(client.closed)
 			client.RemoveClient()
 			break
 		}
@@ -75,6 +106,7 @@ func (client *Client) Read() {
 		if msg.cmd == MSG_AUTH {
 			client.HandleAuth(msg.body.(*Authentication))
 		} else if msg.cmd == MSG_AUTH_TOKEN {
+			client.version = msg.version
 			client.HandleAuthToken(msg.body.(*AuthenticationToken))
 		} else if msg.cmd == MSG_HEARTBEAT {
 
@@ -82,12 +114,52 @@ func (client *Client) Read() {
 			client.HandlePing()
 		} else if msg.cmd == MSG_VOIP_CONTROL {
 			client.HandleVOIPControl(msg.body.(*VOIPControl))
+		} else if msg.cmd == MSG_VOIP_CANDIDATES {
+			client.HandleVOIPCandidates(msg.body.(*VOIPCandidates))
 		} else {
 			log.Info("unknown msg:", msg.cmd)
 		}
 	}
 }
 
+//不阻塞调用者(通常是其它客户端的读协程), 队列满时按照配置的策略处理
+func (client *Client) EnqueueMessage(msg *Message) bool {
+	select {
+	case client.wt <- msg:
+		write_queue_stats.Add("enqueued", 1)
+		return true
+	default:
+	}
+
+	switch GetConfig().write_overflow_policy {
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case <-client.wt:
+				write_queue_stats.Add("dropped_oldest", 1)
+			default:
+			}
+			select {
+			case client.wt <- msg:
+				write_queue_stats.Add("enqueued", 1)
+				return true
+			default:
+			}
+		}
+	case OVERFLOW_DISCONNECT:
+		write_queue_stats.Add("disconnected", 1)
+		log.Warningf("slow consumer appid:%d uid:%d, disconnect", client.appid, client.uid)
+		//读协程出错后会通知写协程退出
+		client.conn.Close()
+		return false
+	default:
+		write_queue_stats.Add("dropped_newest", 1)
+		log.Warningf("write queue full appid:%d uid:%d, drop msg:%s",
+			client.appid, client.uid, Command(msg.cmd))
+		return false
+	}
+}
+
 func (client *Client) SendMessage(uid int64, msg *Message) bool {
 	route := app_route.FindRoute(client.appid)
 	if route == nil {
@@ -97,7 +169,7 @@ func (client *Client) SendMessage(uid int64, msg *Message) bool {
 	clients := route.FindClientSet(uid)
 	if clients != nil {
 		for c, _ := range(clients) {
-			c.wt <- msg
+			c.EnqueueMessage(msg)
 		}
 		return true
 	}
@@ -111,22 +183,34 @@ func (client *Client) AddClient() {
 }
 
 func (client *Client) AuthToken(token string) (int64, int64, error) {
-	appid, uid, _, err := LoadUserAccessToken(token)
+	appid, uid, _, err := LoadUserAccessTokenCached(token)
 	return appid, uid, err
 }
 
 func (client *Client) HandleAuthToken(login *AuthenticationToken) {
+	if IsDraining() {
+		log.Info("server draining, reject auth")
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:1}}
+		client.EnqueueMessage(msg)
+		client.SendReconnectHint()
+		return
+	}
 	appid, uid, err := client.AuthToken(login.token)
-	if err != nil {
+	if err == ErrRedisUnavailable {
 		log.Info("auth token err:", err)
-		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{1, 0}}
-		client.wt <- msg
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:AUTH_STATUS_UNAVAILABLE}}
+		client.EnqueueMessage(msg)
+		return
+	} else if err != nil {
+		log.Info("auth token err:", err)
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:1}}
+		client.EnqueueMessage(msg)
 		return
 	}
 	if uid == 0 || appid == 0 {
 		log.Info("auth token appid==0, uid==0")
-		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{1, 0}}
-		client.wt <- msg
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:1}}
+		client.EnqueueMessage(msg)
 		return
 	}
 
@@ -135,21 +219,47 @@ func (client *Client) HandleAuthToken(login *AuthenticationToken) {
 	client.appid = appid
 	log.Infof("auth appid:%d uid:%d\n", appid, uid)
 
-	msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{0, client.public_ip}}
-	client.wt <- msg
+	status := &AuthenticationStatus{status:0, ip:client.public_ip, relay_addrs:client.relay_addrs}
+	msg := &Message{cmd: MSG_AUTH_STATUS, version: client.version, body: status}
+	client.EnqueueMessage(msg)
+	//旧版本客户端无法解析未知的消息
+	if client.version >= 1 {
+		client.SendRelayInfo()
+	}
 
 	client.SendLoginPoint()
 	client.AddClient()
 }
 
 
+//旧版本无认证的登录方式,只有配置了legacy_appid才允许
 func (client *Client) HandleAuth(login *Authentication) {
+	var ip net.IP
+	if taddr, ok := client.conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = taddr.IP
+	}
+	if IsDraining() {
+		log.Info("server draining, reject legacy auth")
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:1}}
+		client.EnqueueMessage(msg)
+		client.SendReconnectHint()
+		return
+	}
+	if config.legacy_appid == 0 || !GetConfig().IsLegacyIPAllowed(ip) {
+		legacy_auth_stats.Add("tcp_rejected", 1)
+		log.Warningf("legacy auth rejected uid:%d ip:%s", login.uid, ip)
+		msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:1}}
+		client.EnqueueMessage(msg)
+		return
+	}
+
+	legacy_auth_stats.Add("tcp_accepted", 1)
 	client.tm = time.Now()
-	client.appid = 1006
+	client.appid = config.legacy_appid
 	client.uid = login.uid
-	log.Info("auth:", login.uid)
-	msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{0, 0}}
-	client.wt <- msg
+	log.Warningf("deprecated legacy auth appid:%d uid:%d ip:%s", client.appid, login.uid, ip)
+	msg := &Message{cmd: MSG_AUTH_STATUS, body: &AuthenticationStatus{status:0}}
+	client.EnqueueMessage(msg)
 
 	client.AddClient()
 }
@@ -163,13 +273,34 @@ func (client *Client) SendLoginPoint() {
 	client.SendMessage(client.uid, msg)
 }
 
+//告诉客户端媒体数据的中转地址, 客户端不再需要写死tunnel端口
+func (client *Client) SendRelayInfo() {
+	info := &RelayInfo{}
+	for _, addr := range client.relay_addrs {
+		endpoints := relay_endpoints(addr.IP, addr.Port, config.tunnel_tcp_port,
+			config.tunnel_tls_port, config.turn_port)
+		info.endpoints = append(info.endpoints, endpoints...)
+	}
+	if len(info.endpoints) > 255 {
+		info.endpoints = info.endpoints[:255]
+	}
+	msg := &Message{cmd: MSG_RELAY_INFO, body: info}
+	client.EnqueueMessage(msg)
+}
+
+func (client *Client) SendReconnectHint() {
+	msg := &Message{cmd: MSG_RECONNECT, body: &ReconnectHint{int32(GetConfig().reconnect_delay)}}
+	client.EnqueueMessage(msg)
+}
+
 func (client *Client) HandlePing() {
 	msg := &Message{cmd: MSG_PONG}
-	client.wt <- msg
+	client.EnqueueMessage(msg)
 }
 
 
 const VOIP_COMMAND_DIAL = 1
+const VOIP_COMMAND_ACCEPT = 2
 const VOIP_COMMAND_DIAL_VIDEO = 9
 
 
@@ -207,8 +338,6 @@ func (client *Client) PublishMessage(ctl *VOIPControl) {
 	}
 
 	log.Infof("publish invite notification sender:%d receiver:%d", ctl.sender, ctl.receiver)
-	conn := redis_pool.Get()
-	defer conn.Close()
 
 	v := make(map[string]interface{})
 	v["sender"] = ctl.sender
@@ -218,35 +347,158 @@ func (client *Client) PublishMessage(ctl *VOIPControl) {
 
 	appid := client.appid
 	var queue_name string
-	if client.IsROMApp(appid) {
+	if app := GetConfig().GetAppConfig(appid); len(app.push_queue) > 0 {
+		queue_name = app.push_queue
+	} else if client.IsROMApp(appid) {
 		queue_name = fmt.Sprintf("voip_push_queue_%d", appid)
 	} else {
 		queue_name = "voip_push_queue"
 	}
 
-	_, err := conn.Do("RPUSH", queue_name, b)
-	if err != nil {
-		log.Info("error:", err)
+	//不阻塞客户端的读协程
+	r := push_pool.Submit(func() {
+		_, err := redis_store.Do("RPUSH", queue_name, b)
+		if err != nil {
+			log.Info("error:", err)
+		}
+	})
+	if !r {
+		log.Warningf("push queue full, drop notification sender:%d receiver:%d",
+			ctl.sender, ctl.receiver)
 	}
 }
 
+func (client *Client) GetControlCommand(ctl *VOIPControl) int32 {
+	if len(ctl.content) < 4 {
+		return 0
+	}
+	var ctl_cmd int32
+	buffer := bytes.NewBuffer(ctl.content)
+	binary.Read(buffer, binary.BigEndian, &ctl_cmd)
+	return ctl_cmd
+}
+
 func (client *Client) HandleVOIPControl(msg *VOIPControl) {
+	cmd := client.GetControlCommand(msg)
+	if (cmd == VOIP_COMMAND_DIAL || cmd == VOIP_COMMAND_DIAL_VIDEO) && !client.AllowCall(msg.receiver) {
+		return
+	}
 	m := &Message{cmd: MSG_VOIP_CONTROL, body: msg}
 	r := client.SendMessage(msg.receiver, m)
 	if !r {
 		client.PublishMessage(msg)
 	}
+	if r && cmd == VOIP_COMMAND_ACCEPT {
+		client.SelectRelay(msg.receiver)
+	}
+}
+
+//app正在中转的通话数达到上限时拒绝新的呼叫, 不发送给被叫
+func (client *Client) AllowCall(receiver int64) bool {
+	max_calls, _, _ := GetConfig().AppQuota(client.appid)
+	if max_calls == 0 {
+		return true
+	}
+	usage := tunnel.quotas.Get(client.appid)
+	if usage.Calls() < max_calls {
+		return true
+	}
+	usage.stats.Add("rejected_dials", 1)
+	log.Infof("app:%d calls exceeded, reject dial sender:%d receiver:%d", client.appid, client.uid, receiver)
+	//旧版本客户端无法解析未知的消息, 只能等待呼叫超时
+	if client.version >= 1 {
+		reject := &VOIPReject{receiver:receiver, reason:QUOTA_CALLS}
+		client.EnqueueMessage(&Message{cmd: MSG_VOIP_REJECT, body: reject})
+	}
+	return false
+}
+
+func (client *Client) Region() string {
+	if taddr, ok := client.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return GetConfig().ClientRegion(taddr.IP)
+	}
+	return ""
+}
+
+//被叫接听后为通话双方选择同一个中转服务器, 主叫需要连接在本服务器上
+func (client *Client) SelectRelay(peer int64) {
+	route := app_route.FindRoute(client.appid)
+	if route == nil {
+		return
+	}
+	peers := route.FindClientSet(peer)
+	peer_region := ""
+	for c := range peers {
+		peer_region = c.Region()
+		break
+	}
+
+	node := relay_registry.Select(client.Region(), peer_region)
+	if node == nil {
+		relay_stats.Add("no_relay", 1)
+		return
+	}
+	relay_stats.Add("selected", 1)
+	log.Infof("select relay:%s region:%s uid:%d peer:%d", node.ID, node.Region, client.uid, peer)
+
+	endpoints := node.Endpoints()
+	if len(endpoints) > 255 {
+		endpoints = endpoints[:255]
+	}
+	relay := &VOIPRelay{sender:client.uid, receiver:peer, endpoints:endpoints}
+	m := &Message{cmd: MSG_VOIP_RELAY, body: relay}
+	if client.version >= 1 {
+		client.EnqueueMessage(m)
+	}
+	//旧版本客户端无法解析未知的消息
+	for c := range peers {
+		if c.version >= 1 {
+			c.EnqueueMessage(m)
+		}
+	}
 }
 
 
+//转发ice候选地址, 并加上本服务器的中转地址作为最低优先级的relay候选
+func (client *Client) HandleVOIPCandidates(msg *VOIPCandidates) {
+	msg.sender = client.uid
+
+	for _, relay := range client.RelayCandidates() {
+		exists := false
+		for _, c := range msg.candidates {
+			if c.candidate_type == CANDIDATE_RELAY && c.ip.Equal(relay.ip) && c.port == relay.port {
+				exists = true
+				break
+			}
+		}
+		if !exists && len(msg.candidates) < 255 {
+			msg.candidates = append(msg.candidates, relay)
+		}
+	}
+
+	m := &Message{cmd: MSG_VOIP_CANDIDATES, body: msg}
+	client.SendMessage(msg.receiver, m)
+}
+
+func (client *Client) RelayCandidates() []*Candidate {
+	candidates := make([]*Candidate, 0, len(client.relay_addrs))
+	for _, addr := range client.relay_addrs {
+		c := &Candidate{candidate_type:CANDIDATE_RELAY, ip:addr.IP, port:uint16(addr.Port), priority:0}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
 func (client *Client) Write() {
 	seq := 0
 	for {
-		msg := <-client.wt
-		if msg == nil {
+		var msg *Message
+		select {
+		case msg = <-client.wt:
+		case <-client.closed:
 			client.conn.Close()
 			log.Info("socket closed")
-			break
+			return
 		}
 		seq++
 		msg.seq = seq
@@ -19,57 +19,920 @@
 
 package main
 
+import "os"
+import "net"
+import "flag"
+import "fmt"
+import "sort"
+import "runtime"
+import "crypto/tls"
 import "strconv"
-import "log"
+import "strings"
+import "sync/atomic"
+import "io/ioutil"
+import "path/filepath"
 import "github.com/jimlawless/cfg"
+import "gopkg.in/yaml.v2"
+import log "github.com/golang/glog"
 
 
 type Config struct {
 	port               int
 	tunnel_port        int
 	tunnel_port_v2     int
+	http_address       string
+	//为1时在port上接受信令客户端的tcp连接, 默认关闭
+	client_listen      int
+
 	redis_address      string
+	redis_password     string
+	redis_db           int
+	redis_max_idle     int
+	redis_max_active   int
+	redis_idle_timeout int
+
+	//毫秒
+	redis_timeout           int
+	redis_breaker_failures  int
+	redis_breaker_cooldown  int
+
+	tunnel_auth_workers     int
+	tunnel_auth_queue_size  int
+	//每个ip每秒的tunnel认证次数, 0不限制
+	tunnel_auth_rate        int
+	tunnel_auth_burst       int
+	push_workers            int
+	push_queue_size         int
+
+	redis_sentinels         []string
+	redis_master_name       string
+	redis_sentinel_password string
+	redis_cluster_addresses []string
+
+	client_timeout      int
+	gc_hz               int
+	voip_client_timeout int
+	//tunnel客户端被删除时把事件rpush到此redis队列, 为空时不发送
+	tunnel_eviction_queue string
+
+	//每个app的默认配额, 0表示不限制, 可以在apps中覆盖
+	app_max_calls          int
+	app_max_tunnel_clients int
+	//字节/秒
+	app_max_bandwidth      int64
+	//同时存在的TURN分配数
+	app_max_turn_allocations int
+	//全局或者某个app配置了通话数或者带宽的配额, 为false时转发不统计, 加载时计算
+	forward_quota          bool
+
+	//旧版本协议(MSG_AUTH, 无header的tunnel),legacy_appid为0时禁用
+	legacy_appid          int64
+	legacy_tunnel_address string
+	legacy_allow_ips      []*net.IPNet
+
+	//auth_cache_size为0时不使用本地缓存
+	auth_cache_size         int
+	auth_cache_ttl          int
+	auth_cache_negative_ttl int
+	auth_revoke_channel     string
+
+	drain_timeout         int
+	reconnect_delay       int
+
+	write_queue_size      int
+	write_overflow_policy int
+
+	//udp被屏蔽时的tcp/tls中转, 0不启用
+	tunnel_tcp_port          int
+	tunnel_tls_port          int
+	tunnel_tls_cert          string
+	tunnel_tls_key           string
+	tunnel_stream_queue_size int
+	//连接之后必须在此时间(秒)内认证成功, 否则关闭连接
+	tunnel_stream_auth_timeout int
+
+	//每次recvmmsg/sendmmsg的最大包数, 1不使用批量读写
+	tunnel_batch_size        int
+	//SO_REUSEPORT的socket数, 每个socket一个读协程, 0为cpu核数
+	tunnel_readers           int
+
+	//客户端连接tunnel的公网地址, 可以有多个(包括ipv6)
+	//为空时使用信令连接的本机地址
+	tunnel_advertised_ips []net.IP
+
+	//turn_port为0时不启用turn
+	turn_port             int
+	turn_realm            string
+	turn_relay_ip         string
+	turn_max_allocations  int
+	//为1时允许内网和本机地址作为peer
+	turn_allow_private_peers int
+
+	//relay_id为空时不加入中转服务器列表
+	relay_id                 string
+	relay_region             string
+	//0不限制
+	relay_max_sessions       int
+	//字节/秒, 0不限制
+	relay_max_bandwidth      int64
+	relay_heartbeat_interval int
+	//客户端ip所在的区域, 用于选择就近的中转服务器
+	relay_client_regions     []*RegionNet
+
+	//glog的-v, -1表示使用命令行参数
+	log_verbosity         int
+
+	apps map[int64]*AppConfig
 }
 
-func get_int(app_cfg map[string]string, key string) int {
-	concurrency, present := app_cfg[key]
-	if !present {
-		log.Fatalf("key:%s non exist", key)
+//运行时可以重新加载的配置, 监听端口等使用启动时的config
+var config_value atomic.Value
+
+func GetConfig() *Config {
+	return config_value.Load().(*Config)
+}
+
+func SetConfig(config *Config) {
+	config_value.Store(config)
+	if config.log_verbosity >= 0 {
+		flag.Set("v", strconv.Itoa(config.log_verbosity))
 	}
-	n, err := strconv.Atoi(concurrency)
-	if err != nil {
-		log.Fatalf("key:%s is't integer", key)
+}
+
+//按appid覆盖的配置, 0表示使用全局配置
+type AppConfig struct {
+	appid               int64
+	client_timeout      int
+	voip_client_timeout int
+	push_queue          string
+	max_calls           int
+	max_tunnel_clients  int
+	max_bandwidth       int64
+	max_turn_allocations int
+}
+
+//配置项, 同时用于配置文件, 环境变量和命令行参数
+type ConfigOption struct {
+	key      string
+	def      string
+	required bool
+	secret   bool
+	//SIGHUP时是否重新加载
+	reloadable bool
+	parse    func(string) error
+	format   func() string
+}
+
+func int_option(key string, v *int, def int, min int, max int) *ConfigOption {
+	opt := &ConfigOption{key:key, def:strconv.Itoa(def)}
+	opt.parse = func(s string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("key:%s is't integer", key)
+		}
+		if n < min || n > max {
+			return fmt.Errorf("key:%s out of range [%d, %d]", key, min, max)
+		}
+		*v = n
+		return nil
+	}
+	opt.format = func() string {
+		return strconv.Itoa(*v)
+	}
+	return opt
+}
+
+func int64_option(key string, v *int64, def int64) *ConfigOption {
+	opt := &ConfigOption{key:key, def:strconv.FormatInt(def, 10)}
+	opt.parse = func(s string) error {
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("key:%s is't integer", key)
+		}
+		*v = n
+		return nil
+	}
+	opt.format = func() string {
+		return strconv.FormatInt(*v, 10)
+	}
+	return opt
+}
+
+func string_option(key string, v *string, def string) *ConfigOption {
+	opt := &ConfigOption{key:key, def:def}
+	opt.parse = func(s string) error {
+		*v = strings.TrimSpace(s)
+		return nil
+	}
+	opt.format = func() string {
+		return *v
+	}
+	return opt
+}
+
+func string_list_option(key string, v *[]string) *ConfigOption {
+	opt := &ConfigOption{key:key}
+	opt.parse = func(s string) error {
+		items := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		*v = items
+		return nil
+	}
+	opt.format = func() string {
+		return strings.Join(*v, ",")
+	}
+	return opt
+}
+
+func ip_list_option(key string, v *[]net.IP) *ConfigOption {
+	opt := &ConfigOption{key:key}
+	opt.parse = func(s string) error {
+		ips := make([]net.IP, 0)
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			ip := net.ParseIP(item)
+			if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+				return fmt.Errorf("key:%s invalid ip:%s", key, item)
+			}
+			ips = append(ips, ip)
+		}
+		if len(ips) > 255 {
+			return fmt.Errorf("key:%s too many ips", key)
+		}
+		*v = ips
+		return nil
+	}
+	opt.format = func() string {
+		items := make([]string, len(*v))
+		for i, ip := range *v {
+			items[i] = ip.String()
+		}
+		return strings.Join(items, ",")
+	}
+	return opt
+}
+
+func ip_nets_option(key string, v *[]*net.IPNet) *ConfigOption {
+	opt := &ConfigOption{key:key}
+	opt.parse = func(s string) error {
+		nets, err := parse_ip_nets(s)
+		if err != nil {
+			return fmt.Errorf("key:%s %s", key, err)
+		}
+		*v = nets
+		return nil
+	}
+	opt.format = func() string {
+		items := make([]string, len(*v))
+		for i, n := range *v {
+			items[i] = n.String()
+		}
+		return strings.Join(items, ",")
+	}
+	return opt
+}
+
+type RegionNet struct {
+	ipnet  *net.IPNet
+	region string
+}
+
+//格式: cidr=region,cidr=region
+func region_nets_option(key string, v *[]*RegionNet) *ConfigOption {
+	opt := &ConfigOption{key:key}
+	opt.parse = func(s string) error {
+		regions := make([]*RegionNet, 0)
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			pair := strings.SplitN(item, "=", 2)
+			if len(pair) != 2 || strings.TrimSpace(pair[1]) == "" {
+				return fmt.Errorf("key:%s invalid item:%s", key, item)
+			}
+			_, ipnet, err := net.ParseCIDR(strings.TrimSpace(pair[0]))
+			if err != nil {
+				return fmt.Errorf("key:%s invalid cidr:%s", key, pair[0])
+			}
+			regions = append(regions, &RegionNet{ipnet, strings.TrimSpace(pair[1])})
+		}
+		*v = regions
+		return nil
+	}
+	opt.format = func() string {
+		items := make([]string, len(*v))
+		for i, r := range *v {
+			items[i] = r.ipnet.String() + "=" + r.region
+		}
+		return strings.Join(items, ",")
+	}
+	return opt
+}
+
+func (config *Config) TunnelReaders() int {
+	if config.tunnel_readers == 0 {
+		return runtime.NumCPU()
+	}
+	return config.tunnel_readers
+}
+
+//没有匹配的区域时返回空字符串
+func (config *Config) ClientRegion(ip net.IP) string {
+	for _, r := range config.relay_client_regions {
+		if r.ipnet.Contains(ip) {
+			return r.region
+		}
+	}
+	return ""
+}
+
+func overflow_policy_option(key string, v *int) *ConfigOption {
+	opt := &ConfigOption{key:key, def:"drop_newest"}
+	opt.parse = func(s string) error {
+		policy, err := parse_overflow_policy(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("key:%s %s", key, err)
+		}
+		*v = policy
+		return nil
+	}
+	opt.format = func() string {
+		return overflow_policy_name(*v)
+	}
+	return opt
+}
+
+func (config *Config) Options() []*ConfigOption {
+	const MAX_PORT = 65535
+	const MAX_INT = int(^uint32(0) >> 1)
+	opts := []*ConfigOption{
+		int_option("port", &config.port, 0, 0, MAX_PORT),
+		int_option("tunnel_port", &config.tunnel_port, 0, 0, MAX_PORT),
+		int_option("tunnel_port_v2", &config.tunnel_port_v2, 0, 1, MAX_PORT),
+		string_option("http_address", &config.http_address, ""),
+		int_option("client_listen", &config.client_listen, 0, 0, 1),
+
+		string_option("redis_address", &config.redis_address, ""),
+		string_option("redis_password", &config.redis_password, ""),
+		int_option("redis_db", &config.redis_db, 0, 0, MAX_INT),
+		int_option("redis_max_idle", &config.redis_max_idle, 100, 0, MAX_INT),
+		int_option("redis_max_active", &config.redis_max_active, 500, 0, MAX_INT),
+		int_option("redis_idle_timeout", &config.redis_idle_timeout, 480, 0, MAX_INT),
+		int_option("redis_timeout", &config.redis_timeout, 1000, 1, MAX_INT),
+		int_option("redis_breaker_failures", &config.redis_breaker_failures, 5, 1, MAX_INT),
+		int_option("redis_breaker_cooldown", &config.redis_breaker_cooldown, 10, 1, MAX_INT),
+		int_option("tunnel_auth_workers", &config.tunnel_auth_workers, 16, 1, MAX_INT),
+		int_option("tunnel_auth_queue_size", &config.tunnel_auth_queue_size, 1024, 1, MAX_INT),
+		int_option("tunnel_auth_rate", &config.tunnel_auth_rate, 5, 0, MAX_INT),
+		int_option("tunnel_auth_burst", &config.tunnel_auth_burst, 10, 1, MAX_INT),
+		int_option("push_workers", &config.push_workers, 4, 1, MAX_INT),
+		int_option("push_queue_size", &config.push_queue_size, 1024, 1, MAX_INT),
+		string_list_option("redis_sentinels", &config.redis_sentinels),
+		string_option("redis_master_name", &config.redis_master_name, ""),
+		string_option("redis_sentinel_password", &config.redis_sentinel_password, ""),
+		string_list_option("redis_cluster_addresses", &config.redis_cluster_addresses),
+
+		int_option("client_timeout", &config.client_timeout, CLIENT_TIMEOUT, 1, MAX_INT),
+		int_option("gc_hz", &config.gc_hz, GC_HZ, 1, MAX_INT),
+		int_option("voip_client_timeout", &config.voip_client_timeout, VOIP_CLIENT_TIMEOUT, 1, MAX_INT),
+
+		int_option("auth_cache_size", &config.auth_cache_size, 10000, 0, MAX_INT),
+		int_option("auth_cache_ttl", &config.auth_cache_ttl, 60, 1, MAX_INT),
+		int_option("auth_cache_negative_ttl", &config.auth_cache_negative_ttl, 5, 0, MAX_INT),
+		string_option("auth_revoke_channel", &config.auth_revoke_channel, "access_token_revoke"),
+
+		int64_option("legacy_appid", &config.legacy_appid, 0),
+		string_option("legacy_tunnel_address", &config.legacy_tunnel_address, ""),
+		ip_nets_option("legacy_allow_ips", &config.legacy_allow_ips),
+
+		int_option("drain_timeout", &config.drain_timeout, 60*5, 0, MAX_INT),
+		int_option("reconnect_delay", &config.reconnect_delay, 0, 0, MAX_INT),
+
+		int_option("write_queue_size", &config.write_queue_size, 10, 1, MAX_INT),
+		overflow_policy_option("write_overflow_policy", &config.write_overflow_policy),
+
+		ip_list_option("tunnel_advertised_ips", &config.tunnel_advertised_ips),
+
+		int_option("tunnel_tcp_port", &config.tunnel_tcp_port, 0, 0, MAX_PORT),
+		int_option("tunnel_tls_port", &config.tunnel_tls_port, 0, 0, MAX_PORT),
+		string_option("tunnel_tls_cert", &config.tunnel_tls_cert, ""),
+		string_option("tunnel_tls_key", &config.tunnel_tls_key, ""),
+		int_option("tunnel_stream_queue_size", &config.tunnel_stream_queue_size, 256, 1, MAX_INT),
+		int_option("tunnel_stream_auth_timeout", &config.tunnel_stream_auth_timeout, 10, 1, MAX_INT),
+		int_option("tunnel_batch_size", &config.tunnel_batch_size, 32, 1, 1024),
+		int_option("tunnel_readers", &config.tunnel_readers, 1, 0, 1024),
+		string_option("tunnel_eviction_queue", &config.tunnel_eviction_queue, ""),
+
+		int_option("app_max_calls", &config.app_max_calls, 0, 0, MAX_INT),
+		int_option("app_max_tunnel_clients", &config.app_max_tunnel_clients, 0, 0, MAX_INT),
+		int64_option("app_max_bandwidth", &config.app_max_bandwidth, 0),
+		int_option("app_max_turn_allocations", &config.app_max_turn_allocations, 0, 0, MAX_INT),
+
+		int_option("turn_port", &config.turn_port, 0, 0, MAX_PORT),
+		string_option("turn_realm", &config.turn_realm, "voip"),
+		string_option("turn_relay_ip", &config.turn_relay_ip, ""),
+		int_option("turn_max_allocations", &config.turn_max_allocations, 10000, 0, MAX_INT),
+		int_option("turn_allow_private_peers", &config.turn_allow_private_peers, 0, 0, 1),
+
+		string_option("relay_id", &config.relay_id, ""),
+		string_option("relay_region", &config.relay_region, ""),
+		int_option("relay_max_sessions", &config.relay_max_sessions, 0, 0, MAX_INT),
+		int64_option("relay_max_bandwidth", &config.relay_max_bandwidth, 0),
+		int_option("relay_heartbeat_interval", &config.relay_heartbeat_interval, 5, 1, MAX_INT),
+		region_nets_option("relay_client_regions", &config.relay_client_regions),
+
+		int_option("log_verbosity", &config.log_verbosity, -1, -1, MAX_INT),
+	}
+	for _, opt := range opts {
+		switch opt.key {
+		case "tunnel_port_v2":
+			opt.required = true
+		case "redis_password", "redis_sentinel_password":
+			opt.secret = true
+		case "client_timeout", "gc_hz", "voip_client_timeout", "legacy_allow_ips",
+			"auth_cache_ttl", "auth_cache_negative_ttl",
+			"tunnel_auth_rate", "tunnel_auth_burst", "tunnel_stream_auth_timeout", "turn_max_allocations", "turn_allow_private_peers",
+			"drain_timeout", "reconnect_delay", "write_queue_size",
+			"write_overflow_policy", "relay_max_sessions", "relay_max_bandwidth",
+			"relay_client_regions", "tunnel_eviction_queue",
+			"app_max_calls", "app_max_tunnel_clients", "app_max_bandwidth",
+			"app_max_turn_allocations", "log_verbosity":
+			opt.reloadable = true
+		}
+	}
+	return opts
+}
+
+func (app *AppConfig) Options() []*ConfigOption {
+	const MAX_INT = int(^uint32(0) >> 1)
+	return []*ConfigOption{
+		int64_option("appid", &app.appid, 0),
+		int_option("client_timeout", &app.client_timeout, 0, 0, MAX_INT),
+		int_option("voip_client_timeout", &app.voip_client_timeout, 0, 0, MAX_INT),
+		string_option("push_queue", &app.push_queue, ""),
+		int_option("max_calls", &app.max_calls, 0, 0, MAX_INT),
+		int_option("max_tunnel_clients", &app.max_tunnel_clients, 0, 0, MAX_INT),
+		int64_option("max_bandwidth", &app.max_bandwidth, 0),
+		int_option("max_turn_allocations", &app.max_turn_allocations, 0, 0, MAX_INT),
+	}
+}
+
+//返回appid对应的配置, 未覆盖的配置项使用全局配置
+func (config *Config) GetAppConfig(appid int64) *AppConfig {
+	app := &AppConfig{appid:appid, client_timeout:config.client_timeout,
+		voip_client_timeout:config.voip_client_timeout}
+	if c, ok := config.apps[appid]; ok {
+		if c.client_timeout > 0 {
+			app.client_timeout = c.client_timeout
+		}
+		if c.voip_client_timeout > 0 {
+			app.voip_client_timeout = c.voip_client_timeout
+		}
+		app.push_queue = c.push_queue
+	}
+	app.max_calls, app.max_tunnel_clients, app.max_bandwidth = config.AppQuota(appid)
+	app.max_turn_allocations = config.AppTURNQuota(appid)
+	return app
+}
+
+//不分配内存, 在转发路径上使用
+func (config *Config) AppQuota(appid int64) (int, int, int64) {
+	max_calls := config.app_max_calls
+	max_tunnel_clients := config.app_max_tunnel_clients
+	max_bandwidth := config.app_max_bandwidth
+	if c, ok := config.apps[appid]; ok {
+		if c.max_calls > 0 {
+			max_calls = c.max_calls
+		}
+		if c.max_tunnel_clients > 0 {
+			max_tunnel_clients = c.max_tunnel_clients
+		}
+		if c.max_bandwidth > 0 {
+			max_bandwidth = c.max_bandwidth
+		}
 	}
-	return n
+	return max_calls, max_tunnel_clients, max_bandwidth
 }
 
-func get_string(app_cfg map[string]string, key string) string {
-	concurrency, present := app_cfg[key]
-	if !present {
-		log.Fatalf("key:%s non exist", key)
+func (config *Config) AppTURNQuota(appid int64) int {
+	if c, ok := config.apps[appid]; ok && c.max_turn_allocations > 0 {
+		return c.max_turn_allocations
 	}
-	return concurrency
+	return config.app_max_turn_allocations
 }
 
-func get_opt_string(app_cfg map[string]string, key string) string {
-	concurrency, present := app_cfg[key]
-	if !present {
+func (config *Config) has_forward_quota() bool {
+	if config.app_max_calls > 0 || config.app_max_bandwidth > 0 {
+		return true
+	}
+	for _, app := range config.apps {
+		if app.max_calls > 0 || app.max_bandwidth > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//未配置白名单时允许所有ip
+func (config *Config) IsLegacyIPAllowed(ip net.IP) bool {
+	if len(config.legacy_allow_ips) == 0 {
+		return true
+	}
+	for _, n := range config.legacy_allow_ips {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse_overflow_policy(s string) (int, error) {
+	switch s {
+	case "", "drop_newest":
+		return OVERFLOW_DROP_NEWEST, nil
+	case "drop_oldest":
+		return OVERFLOW_DROP_OLDEST, nil
+	case "disconnect":
+		return OVERFLOW_DISCONNECT, nil
+	default:
+		return 0, fmt.Errorf("invalid overflow policy:%s", s)
+	}
+}
+
+func overflow_policy_name(policy int) string {
+	switch policy {
+	case OVERFLOW_DROP_OLDEST:
+		return "drop_oldest"
+	case OVERFLOW_DISCONNECT:
+		return "disconnect"
+	default:
+		return "drop_newest"
+	}
+}
+
+//逗号分隔的ip或者cidr
+func parse_ip_nets(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip:%s", item)
+			}
+			if ip.To4() != nil {
+				item = item + "/32"
+			} else {
+				item = item + "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr:%s", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//yaml的标量和列表转换成字符串, 列表用逗号分隔
+func yaml_value_string(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	if v == nil {
 		return ""
 	}
-	return concurrency
+	return fmt.Sprint(v)
 }
 
-func read_cfg(cfg_path string) *Config {
-	config := new(Config)
-	app_cfg := make(map[string]string)
-	err := cfg.Load(cfg_path, app_cfg)
+//应用默认值和values中的配置项, 返回所有错误
+func apply_options(opts []*ConfigOption, values map[string]string, prefix string) []error {
+	errs := make([]error, 0)
+	known := make(map[string]bool)
+	for _, opt := range opts {
+		known[opt.key] = true
+		if len(opt.def) > 0 {
+			opt.parse(opt.def)
+		}
+		s, present := values[opt.key]
+		if !present {
+			if opt.required {
+				errs = append(errs, fmt.Errorf("%skey:%s non exist", prefix, opt.key))
+			}
+			continue
+		}
+		if err := opt.parse(s); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s", prefix, err))
+		}
+	}
+
+	keys := make([]string, 0)
+	for key := range values {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("%sunknown key:%s", prefix, key))
+	}
+	return errs
+}
+
+func load_yaml_cfg(cfg_path string) (map[string]string, []map[string]string, error) {
+	data, err := ioutil.ReadFile(cfg_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &doc)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
+	}
+
+	values := make(map[string]string)
+	apps := make([]map[string]string, 0)
+	for key, v := range doc {
+		if key != "apps" {
+			values[key] = yaml_value_string(v)
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("apps should be list")
+		}
+		for _, item := range list {
+			m, ok := item.(map[interface{}]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("apps item should be map")
+			}
+			app := make(map[string]string)
+			for k, v := range m {
+				app[fmt.Sprint(k)] = yaml_value_string(v)
+			}
+			apps = append(apps, app)
+		}
+	}
+	return values, apps, nil
+}
+
+//环境变量VOIP_<KEY>覆盖配置文件
+const CONFIG_ENV_PREFIX = "VOIP_"
+
+var config_flags map[string]*string = make(map[string]*string)
+
+//每个配置项对应一个命令行参数, 优先级最高
+func RegisterConfigFlags() {
+	for _, opt := range new(Config).Options() {
+		config_flags[opt.key] = flag.String(opt.key, "", "override config "+opt.key)
+	}
+}
+
+//优先级: 默认值 < 配置文件 < 环境变量 < 命令行参数
+func config_overrides() map[string]string {
+	values := make(map[string]string)
+	for _, opt := range new(Config).Options() {
+		env := CONFIG_ENV_PREFIX + strings.ToUpper(opt.key)
+		if v, ok := os.LookupEnv(env); ok {
+			values[opt.key] = v
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if v, ok := config_flags[f.Name]; ok {
+			values[f.Name] = *v
+		}
+	})
+	return values
+}
+
+//支持yaml(.yaml/.yml)和旧的key=value格式, cfg_path为空时只使用环境变量和命令行参数
+//返回所有的配置错误
+func load_cfg(cfg_path string) (*Config, []error) {
+	var values map[string]string
+	var apps []map[string]string
+
+	ext := filepath.Ext(cfg_path)
+	if cfg_path == "" {
+		values = make(map[string]string)
+	} else if ext == ".yaml" || ext == ".yml" {
+		var err error
+		values, apps, err = load_yaml_cfg(cfg_path)
+		if err != nil {
+			return nil, []error{err}
+		}
+	} else {
+		values = make(map[string]string)
+		err := cfg.Load(cfg_path, values)
+		if err != nil {
+			return nil, []error{err}
+		}
+	}
+
+	for key, v := range config_overrides() {
+		values[key] = v
 	}
 
-	config.port = get_int(app_cfg, "port")
-	config.tunnel_port = get_int(app_cfg, "tunnel_port")
-	config.tunnel_port_v2 = get_int(app_cfg, "tunnel_port_v2")
-	config.redis_address = get_string(app_cfg, "redis_address")
+	config := new(Config)
+	errs := apply_options(config.Options(), values, "")
+
+	config.apps = make(map[int64]*AppConfig)
+	for i, m := range apps {
+		app := new(AppConfig)
+		prefix := fmt.Sprintf("apps[%d] ", i)
+		errs = append(errs, apply_options(app.Options(), m, prefix)...)
+		if app.appid == 0 {
+			errs = append(errs, fmt.Errorf("%sappid is required", prefix))
+			continue
+		}
+		if _, ok := config.apps[app.appid]; ok {
+			errs = append(errs, fmt.Errorf("%sduplicate appid:%d", prefix, app.appid))
+			continue
+		}
+		config.apps[app.appid] = app
+	}
+
+	if config.legacy_tunnel_address == "" && config.tunnel_port > 0 {
+		config.legacy_tunnel_address = fmt.Sprintf(":%d", config.tunnel_port)
+	}
+	config.forward_quota = config.has_forward_quota()
+	errs = append(errs, config.Validate()...)
+	return config, errs
+}
+
+func (config *Config) Validate() []error {
+	errs := make([]error, 0)
+	if len(config.redis_cluster_addresses) > 0 {
+		if len(config.redis_sentinels) > 0 {
+			errs = append(errs, fmt.Errorf("redis_sentinels and redis_cluster_addresses are exclusive"))
+		}
+		if config.redis_db != 0 {
+			errs = append(errs, fmt.Errorf("redis_db must be 0 in cluster mode"))
+		}
+	} else if len(config.redis_sentinels) > 0 {
+		if config.redis_master_name == "" {
+			errs = append(errs, fmt.Errorf("key:redis_master_name non exist"))
+		}
+	} else if config.redis_address == "" {
+		errs = append(errs, fmt.Errorf("key:redis_address non exist"))
+	}
+	if config.redis_max_active > 0 && config.redis_max_idle > config.redis_max_active {
+		errs = append(errs, fmt.Errorf("redis_max_idle:%d > redis_max_active:%d",
+			config.redis_max_idle, config.redis_max_active))
+	}
+	if config.client_listen != 0 && config.port == 0 {
+		errs = append(errs, fmt.Errorf("client_listen requires port"))
+	}
+	if config.port > 0 && (config.port == config.tunnel_port || config.port == config.tunnel_port_v2) {
+		errs = append(errs, fmt.Errorf("port:%d conflicts with tunnel port", config.port))
+	}
+	if config.tunnel_port > 0 && config.tunnel_port == config.tunnel_port_v2 {
+		errs = append(errs, fmt.Errorf("tunnel_port:%d conflicts with tunnel_port_v2", config.tunnel_port))
+	}
+	if config.legacy_tunnel_address != "" {
+		if _, err := net.ResolveUDPAddr("udp", config.legacy_tunnel_address); err != nil {
+			errs = append(errs, fmt.Errorf("invalid legacy_tunnel_address:%s", config.legacy_tunnel_address))
+		}
+	}
+	if config.turn_port > 0 {
+		if config.turn_port == config.tunnel_port || config.turn_port == config.tunnel_port_v2 {
+			errs = append(errs, fmt.Errorf("turn_port:%d conflicts with tunnel port", config.turn_port))
+		}
+		if ip := net.ParseIP(config.turn_relay_ip); ip == nil || ip.IsUnspecified() {
+			errs = append(errs, fmt.Errorf("invalid turn_relay_ip:%s", config.turn_relay_ip))
+		}
+		if !turn_realm_valid(config.turn_realm) {
+			errs = append(errs, fmt.Errorf("invalid turn_realm:%s", config.turn_realm))
+		}
+	}
+	for _, p := range []int{config.tunnel_tcp_port, config.tunnel_tls_port} {
+		if p > 0 && p == config.port {
+			errs = append(errs, fmt.Errorf("tunnel stream port:%d conflicts with port", p))
+		}
+	}
+	if config.tunnel_tcp_port > 0 && config.tunnel_tcp_port == config.tunnel_tls_port {
+		errs = append(errs, fmt.Errorf("tunnel_tcp_port:%d conflicts with tunnel_tls_port", config.tunnel_tcp_port))
+	}
+	if config.tunnel_tls_port > 0 {
+		if _, err := tls.LoadX509KeyPair(config.tunnel_tls_cert, config.tunnel_tls_key); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tunnel_tls_cert/tunnel_tls_key:%s", err))
+		}
+	}
+	if config.relay_id != "" && len(config.tunnel_advertised_ips) == 0 {
+		errs = append(errs, fmt.Errorf("relay_id requires tunnel_advertised_ips"))
+	}
+	if config.http_address != "" {
+		if _, err := net.ResolveTCPAddr("tcp", config.http_address); err != nil {
+			errs = append(errs, fmt.Errorf("invalid http_address:%s", config.http_address))
+		}
+	}
+	return errs
+}
+
+func (opt *ConfigOption) Value() string {
+	if opt.secret && len(opt.format()) > 0 {
+		return "******"
+	}
+	return opt.format()
+}
+
+func format_app_config(app *AppConfig) string {
+	return fmt.Sprintf("client_timeout:%d voip_client_timeout:%d push_queue:%s "+
+		"max_calls:%d max_tunnel_clients:%d max_bandwidth:%d max_turn_allocations:%d",
+		app.client_timeout, app.voip_client_timeout, app.push_queue,
+		app.max_calls, app.max_tunnel_clients, app.max_bandwidth, app.max_turn_allocations)
+}
+
+//重新加载配置文件, 只替换可以安全修改的配置项
+func ReloadConfig(cfg_path string) bool {
+	new_config, errs := load_cfg(cfg_path)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error("reload config error:", err)
+		}
+		return false
+	}
+
+	old_config := GetConfig()
+	config := new(Config)
+	*config = *old_config
+
+	old_opts := old_config.Options()
+	new_opts := new_config.Options()
+	opts := config.Options()
+	for i, opt := range opts {
+		//用原始值比较, 只在输出时隐藏密码
+		if old_opts[i].format() == new_opts[i].format() {
+			continue
+		}
+		if !opt.reloadable {
+			log.Warningf("config %s changed, restart required", opt.key)
+			continue
+		}
+		opt.parse(new_opts[i].format())
+		log.Infof("config %s changed:%s -> %s", opt.key, old_opts[i].Value(), new_opts[i].Value())
+	}
+
+	for appid, app := range new_config.apps {
+		old_app, ok := old_config.apps[appid]
+		if !ok {
+			log.Infof("config app:%d added %s", appid, format_app_config(app))
+		} else if format_app_config(old_app) != format_app_config(app) {
+			log.Infof("config app:%d changed %s -> %s", appid,
+				format_app_config(old_app), format_app_config(app))
+		}
+	}
+	for appid := range old_config.apps {
+		if _, ok := new_config.apps[appid]; !ok {
+			log.Infof("config app:%d removed", appid)
+		}
+	}
+	config.apps = new_config.apps
+	config.forward_quota = config.has_forward_quota()
+
+	SetConfig(config)
+	log.Info("config reloaded")
+	return true
+}
+
+//打印最终生效的配置, 密码等用*代替
+func PrintConfig(config *Config) {
+	for _, opt := range config.Options() {
+		fmt.Printf("%s=%s\n", opt.key, opt.Value())
+	}
+	appids := make([]int64, 0, len(config.apps))
+	for appid := range config.apps {
+		appids = append(appids, appid)
+	}
+	sort.Slice(appids, func(i, j int) bool { return appids[i] < appids[j] })
+	for _, appid := range appids {
+		fmt.Printf("app %d %s\n", appid, format_app_config(config.apps[appid]))
+	}
+}
+
+func read_cfg(cfg_path string) *Config {
+	config, errs := load_cfg(cfg_path)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "config error:", err)
+		}
+		os.Exit(1)
+	}
 	return config
 }
@@ -0,0 +1,461 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "os"
+import "fmt"
+import "net"
+import "time"
+import "sync"
+import "errors"
+import "context"
+import "syscall"
+import "golang.org/x/sys/unix"
+import "strings"
+import "strconv"
+import "os/exec"
+import "io/ioutil"
+import "encoding/json"
+import log "github.com/golang/glog"
+
+//热重启: 新进程继承监听的tcp/udp socket以及tunnel的客户端表,
+//通话中的客户端不受影响
+const HANDOFF_ENV = "VOIP_HANDOFF_FDS"
+const HANDOFF_READY_TIMEOUT = 10
+
+type TunnelClientSnapshot struct {
+	Appid     int64  `json:"appid"`
+	Uid       int64  `json:"uid"`
+	Addr      string `json:"addr"`
+	Timestamp int64  `json:"timestamp"`
+	HasHeader bool   `json:"has_header"`
+	Token     string `json:"token"`
+}
+
+//从父进程继承的文件, name -> file
+var inherited_files map[string]*os.File = make(map[string]*os.File)
+//各个监听协程并发取出继承的socket
+var inherited_mutex sync.Mutex
+
+var udp_conns_mutex sync.Mutex
+var udp_conns map[string]*net.UDPConn = make(map[string]*net.UDPConn)
+
+//热重启时暂停所有udp读协程
+type ReaderGate struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	paused  bool
+	waiting int
+}
+
+var reader_gate *ReaderGate = NewReaderGate()
+
+func NewReaderGate() *ReaderGate {
+	gate := new(ReaderGate)
+	gate.cond = sync.NewCond(&gate.mutex)
+	return gate
+}
+
+func (gate *ReaderGate) IsPaused() bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	return gate.paused
+}
+
+//读协程在读出错并且处于暂停状态时调用, 直到恢复
+func (gate *ReaderGate) Wait() {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.waiting++
+	gate.cond.Broadcast()
+	for gate.paused {
+		gate.cond.Wait()
+	}
+	gate.waiting--
+}
+
+func (gate *ReaderGate) Pause(readers int) {
+	gate.mutex.Lock()
+	gate.paused = true
+	gate.mutex.Unlock()
+
+	udp_conns_mutex.Lock()
+	for _, conn := range udp_conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	udp_conns_mutex.Unlock()
+
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	for gate.waiting < readers {
+		gate.cond.Wait()
+	}
+}
+
+func (gate *ReaderGate) Resume() {
+	udp_conns_mutex.Lock()
+	for _, conn := range udp_conns {
+		conn.SetReadDeadline(time.Time{})
+	}
+	udp_conns_mutex.Unlock()
+
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.paused = false
+	gate.cond.Broadcast()
+}
+
+//解析环境变量 name:fd,name:fd
+func LoadInheritedFiles() {
+	env := os.Getenv(HANDOFF_ENV)
+	if len(env) == 0 {
+		return
+	}
+	os.Unsetenv(HANDOFF_ENV)
+	for _, item := range strings.Split(env, ",") {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			log.Warning("invalid handoff fd:", item)
+			continue
+		}
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			log.Warning("invalid handoff fd:", item)
+			continue
+		}
+		name := item[:i]
+		inherited_files[name] = os.NewFile(uintptr(fd), name)
+	}
+	log.Infof("inherited files:%d", len(inherited_files))
+}
+
+func IsHandoffChild() bool {
+	inherited_mutex.Lock()
+	defer inherited_mutex.Unlock()
+	return len(inherited_files) > 0
+}
+
+func take_inherited_file(name string) (*os.File, bool) {
+	inherited_mutex.Lock()
+	defer inherited_mutex.Unlock()
+	f, ok := inherited_files[name]
+	if ok {
+		delete(inherited_files, name)
+	}
+	return f, ok
+}
+
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	return listen_udp(addr, addr, false)
+}
+
+//SO_REUSEPORT: 多个socket绑定同一个端口, 内核按照四元组把包分配给不同的socket,
+//同一个客户端的包总是由同一个socket接收
+func ListenUDPReusePort(addr string, n int) ([]*net.UDPConn, error) {
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		//第一个socket的名字和ListenUDP相同, 可以从单个socket的进程热重启
+		name := addr
+		if i > 0 {
+			name = fmt.Sprintf("%s#%d", addr, i)
+		}
+		conn, err := listen_udp(name, addr, n > 1)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			if i > 0 {
+				//父进程的socket没有设置SO_REUSEPORT
+				return nil, fmt.Errorf("%s, socket count changed, restart required", err)
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	//父进程的socket比较多, 不关闭的话内核仍然会把包分配给它们
+	inherited_mutex.Lock()
+	defer inherited_mutex.Unlock()
+	prefix := "udp:" + addr + "#"
+	for name, f := range inherited_files {
+		if strings.HasPrefix(name, prefix) {
+			log.Warning("close unused inherited udp conn:", name)
+			f.Close()
+			delete(inherited_files, name)
+		}
+	}
+	return conns, nil
+}
+
+func reuseport_control(network, address string, c syscall.RawConn) error {
+	var err error
+	e := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+//name用于热重启时在父子进程之间传递socket
+func listen_udp(name string, addr string, reuseport bool) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if f, ok := take_inherited_file("udp:" + name); ok {
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		udp_conn, ok := c.(*net.UDPConn)
+		if !ok {
+			c.Close()
+			return nil, errors.New("inherited file isn't udp conn")
+		}
+		log.Info("inherit udp conn:", name)
+		conn = udp_conn
+	} else if reuseport {
+		lc := net.ListenConfig{Control:reuseport_control}
+		c, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn = c.(*net.UDPConn)
+	} else {
+		laddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	udp_conns_mutex.Lock()
+	defer udp_conns_mutex.Unlock()
+	udp_conns[name] = conn
+	return conn, nil
+}
+
+func ListenTCP(addr string) (*net.TCPListener, error) {
+	name := "tcp:" + addr
+	if f, ok := take_inherited_file(name); ok {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listener, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, errors.New("inherited file isn't tcp listener")
+		}
+		log.Info("inherit tcp listener:", addr)
+		return listener, nil
+	}
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", laddr)
+}
+
+//子进程恢复父进程的tunnel客户端表, 并通知父进程可以退出
+func RestoreHandoff() {
+	if f, ok := take_inherited_file("snapshot"); ok {
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			log.Error("read snapshot err:", err)
+		} else {
+			tunnel.Restore(data)
+		}
+	}
+}
+
+func NotifyHandoffReady() {
+	if f, ok := take_inherited_file("ready"); ok {
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+func (tunnel *Tunnel) Snapshot() ([]byte, error) {
+	udp_clients := tunnel.UDPClients()
+	clients := make([]*TunnelClientSnapshot, 0, len(udp_clients))
+	for _, c := range udp_clients {
+		s := &TunnelClientSnapshot{
+			Appid:     c.appid,
+			Uid:       c.uid,
+			Addr:      c.addr.String(),
+			Timestamp: c.Timestamp(),
+			HasHeader: c.has_header,
+			Token:     c.token,
+		}
+		clients = append(clients, s)
+	}
+	return json.Marshal(clients)
+}
+
+func (tunnel *Tunnel) Restore(data []byte) {
+	var clients []*TunnelClientSnapshot
+	err := json.Unmarshal(data, &clients)
+	if err != nil {
+		log.Error("unmarshal snapshot err:", err)
+		return
+	}
+	for _, s := range clients {
+		addr, err := net.ResolveUDPAddr("udp", s.Addr)
+		if err != nil {
+			log.Warning("invalid snapshot addr:", s.Addr)
+			continue
+		}
+		client := NewTunnelClient(addr)
+		client.appid = s.Appid
+		client.uid = s.Uid
+		client.timestamp = s.Timestamp
+		client.has_header = s.HasHeader
+		client.token = s.Token
+		//新进程的配额计数从0开始, 恢复的客户端重新计入, 但是不受上限限制
+		tunnel.add_tunnel_client(client, 0)
+	}
+	log.Infof("restore tunnel clients:%d", len(clients))
+}
+
+//暂停udp读协程, 启动新进程并移交socket和客户端表
+//成功返回nil, 此时当前进程应该退出
+func HotRestart() error {
+	udp_conns_mutex.Lock()
+	readers := len(udp_conns)
+	udp_conns_mutex.Unlock()
+
+	reader_gate.Pause(readers)
+
+	err := spawn_child()
+	if err != nil {
+		log.Error("hot restart err:", err)
+		reader_gate.Resume()
+		return err
+	}
+	return nil
+}
+
+func spawn_child() error {
+	files := make([]*os.File, 0)
+	names := make([]string, 0)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	udp_conns_mutex.Lock()
+	for addr, conn := range udp_conns {
+		f, err := conn.File()
+		if err != nil {
+			udp_conns_mutex.Unlock()
+			return err
+		}
+		files = append(files, f)
+		names = append(names, "udp:"+addr)
+	}
+	udp_conns_mutex.Unlock()
+
+	listeners_mutex.Lock()
+	for addr, listener := range listeners {
+		f, err := listener.File()
+		if err != nil {
+			listeners_mutex.Unlock()
+			return err
+		}
+		files = append(files, f)
+		names = append(names, "tcp:"+addr)
+	}
+	listeners_mutex.Unlock()
+
+	snapshot, err := tunnel.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	snapshot_r, snapshot_w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer snapshot_w.Close()
+	files = append(files, snapshot_r)
+	names = append(names, "snapshot")
+
+	ready_r, ready_w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready_r.Close()
+	files = append(files, ready_w)
+	names = append(names, "ready")
+
+	fds := make([]string, len(names))
+	for i, name := range names {
+		//ExtraFiles从3开始
+		fds[i] = fmt.Sprintf("%s:%d", name, i+3)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), HANDOFF_ENV+"="+strings.Join(fds, ","))
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	_, err = snapshot_w.Write(snapshot)
+	snapshot_w.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	//子进程启动完成后写入一个字节
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := ready_r.Read(b)
+		ready <- err
+	}()
+
+	//关闭父进程持有的写端, 子进程异常退出时读端返回EOF
+	ready_w.Close()
+	select {
+	case err = <-ready:
+	case <-time.After(HANDOFF_READY_TIMEOUT * time.Second):
+		err = errors.New("wait child ready timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	log.Infof("hot restart child pid:%d", cmd.Process.Pid)
+	return nil
+}
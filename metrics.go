@@ -0,0 +1,49 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "expvar"
+import "net/http"
+import log "github.com/golang/glog"
+
+//通过http_address的/debug/vars查看
+var legacy_auth_stats = expvar.NewMap("legacy_auth")
+var write_queue_stats = expvar.NewMap("write_queue")
+var auth_cache_stats = expvar.NewMap("auth_cache")
+var breaker_stats = expvar.NewMap("breaker")
+var worker_pool_stats = expvar.NewMap("worker_pool")
+var tunnel_auth_stats = expvar.NewMap("tunnel_auth")
+var stun_stats = expvar.NewMap("stun")
+var turn_stats = expvar.NewMap("turn")
+var relay_stats = expvar.NewMap("relay")
+var tunnel_stream_stats = expvar.NewMap("tunnel_stream")
+var batch_io_stats = expvar.NewMap("batch_io")
+var tunnel_gc_stats = expvar.NewMap("tunnel_gc")
+var app_quota_stats = expvar.NewMap("app_quota")
+
+func ListenHTTP() {
+	if len(config.http_address) == 0 {
+		return
+	}
+	err := http.ListenAndServe(config.http_address, nil)
+	if err != nil {
+		log.Error("http listen err:", err)
+	}
+}
@@ -20,6 +20,7 @@
 package main
 
 import "io"
+import "net"
 import "bytes"
 import "encoding/binary"
 import "fmt"
@@ -34,8 +35,32 @@ const MSG_PING = 13
 const MSG_PONG = 14
 const MSG_AUTH_TOKEN = 15
 const MSG_LOGIN_POINT = 16
+const MSG_RECONNECT = 17
 
 const MSG_VOIP_CONTROL = 64
+const MSG_VOIP_CANDIDATES = 66
+const MSG_RELAY_INFO = 67
+const MSG_VOIP_RELAY = 68
+const MSG_VOIP_REJECT = 69
+
+//MSG_AUTH_STATUS和VOIP_AUTH_STATUS的状态
+const AUTH_STATUS_SUCCESS = 0
+const AUTH_STATUS_FAILURE = 1
+//redis不可用,稍后重试
+const AUTH_STATUS_UNAVAILABLE = 2
+const AUTH_STATUS_INVALID_TOKEN = 3
+const AUTH_STATUS_EXPIRED = 4
+//认证队列已满,稍后重试
+const AUTH_STATUS_BUSY = 5
+//认证过于频繁
+const AUTH_STATUS_RATE_LIMITED = 6
+//app的tunnel客户端数超过限制
+const AUTH_STATUS_QUOTA_EXCEEDED = 7
+
+//超过的app配额, 用于MSG_VOIP_REJECT和VOIP_QUOTA_EXCEEDED
+const QUOTA_TUNNEL_CLIENTS = 1
+const QUOTA_CALLS = 2
+const QUOTA_BANDWIDTH = 3
 
 
 var message_descriptions map[int]string = make(map[int]string)
@@ -49,10 +74,15 @@ var vmessage_creators map[int]VersionMessageCreator = make(map[int]VersionMessag
 
 func init() {
 	message_creators[MSG_AUTH] = func()IMessage {return new(Authentication)}
-	message_creators[MSG_AUTH_STATUS] = func()IMessage {return new(AuthenticationStatus)}
+	vmessage_creators[MSG_AUTH_STATUS] = func()IVersionMessage {return new(AuthenticationStatus)}
 	message_creators[MSG_AUTH_TOKEN] = func()IMessage{return new(AuthenticationToken)}
 	message_creators[MSG_VOIP_CONTROL] = func()IMessage{return new(VOIPControl)}
 	message_creators[MSG_LOGIN_POINT] = func()IMessage{return new(LoginPoint)}
+	message_creators[MSG_RECONNECT] = func()IMessage{return new(ReconnectHint)}
+	message_creators[MSG_VOIP_CANDIDATES] = func()IMessage{return new(VOIPCandidates)}
+	message_creators[MSG_RELAY_INFO] = func()IMessage{return new(RelayInfo)}
+	message_creators[MSG_VOIP_RELAY] = func()IMessage{return new(VOIPRelay)}
+	message_creators[MSG_VOIP_REJECT] = func()IMessage{return new(VOIPReject)}
 
 	
 	message_descriptions[MSG_AUTH] = "MSG_AUTH"
@@ -61,6 +91,12 @@ func init() {
 	message_descriptions[MSG_PING] = "MSG_PING"
 	message_descriptions[MSG_PONG] = "MSG_PONG"
 	message_descriptions[MSG_AUTH_TOKEN] = "MSG_AUTH_TOKEN"
+	message_descriptions[MSG_LOGIN_POINT] = "MSG_LOGIN_POINT"
+	message_descriptions[MSG_RECONNECT] = "MSG_RECONNECT"
+	message_descriptions[MSG_VOIP_CANDIDATES] = "MSG_VOIP_CANDIDATES"
+	message_descriptions[MSG_RELAY_INFO] = "MSG_RELAY_INFO"
+	message_descriptions[MSG_VOIP_RELAY] = "MSG_VOIP_RELAY"
+	message_descriptions[MSG_VOIP_REJECT] = "MSG_VOIP_REJECT"
 }
 
 type Command int
@@ -201,6 +237,211 @@ func (ctl *VOIPControl) FromData(buff []byte) bool {
 	return true
 }
 
+const CANDIDATE_HOST = 1
+const CANDIDATE_SERVER_REFLEXIVE = 2
+const CANDIDATE_RELAY = 3
+
+type Candidate struct {
+	candidate_type uint8
+	ip             net.IP
+	port           uint16
+	priority       uint32
+}
+
+//ice候选地址
+//每个候选地址: 类型(1) ip长度(1) ip 端口(2) 优先级(4)
+type VOIPCandidates struct {
+	sender     int64
+	receiver   int64
+	candidates []*Candidate
+}
+
+func (c *VOIPCandidates) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, c.sender)
+	binary.Write(buffer, binary.BigEndian, c.receiver)
+	buffer.WriteByte(byte(len(c.candidates)))
+	for _, candidate := range c.candidates {
+		ip := candidate.ip.To4()
+		if ip == nil {
+			ip = candidate.ip.To16()
+		}
+		buffer.WriteByte(candidate.candidate_type)
+		buffer.WriteByte(byte(len(ip)))
+		buffer.Write(ip)
+		binary.Write(buffer, binary.BigEndian, candidate.port)
+		binary.Write(buffer, binary.BigEndian, candidate.priority)
+	}
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (c *VOIPCandidates) FromData(buff []byte) bool {
+	if len(buff) < 17 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &c.sender)
+	binary.Read(buffer, binary.BigEndian, &c.receiver)
+	count, _ := buffer.ReadByte()
+	c.candidates = make([]*Candidate, 0, count)
+	for i := 0; i < int(count); i++ {
+		if buffer.Len() < 2 {
+			return false
+		}
+		candidate := new(Candidate)
+		candidate.candidate_type, _ = buffer.ReadByte()
+		l, _ := buffer.ReadByte()
+		if (l != 4 && l != 16) || buffer.Len() < int(l)+6 {
+			return false
+		}
+		candidate.ip = net.IP(append([]byte(nil), buffer.Next(int(l))...))
+		binary.Read(buffer, binary.BigEndian, &candidate.port)
+		binary.Read(buffer, binary.BigEndian, &candidate.priority)
+		c.candidates = append(c.candidates, candidate)
+	}
+	return true
+}
+
+const RELAY_TYPE_TUNNEL = 1
+const RELAY_TYPE_TURN = 2
+
+const RELAY_TRANSPORT_UDP = 1
+const RELAY_TRANSPORT_TCP = 2
+const RELAY_TRANSPORT_TLS = 3
+
+//使用access token认证(VOIP_AUTH)
+const RELAY_AUTH_TOKEN = 1
+//TURN长期凭证, username和password都是access token
+const RELAY_AUTH_TURN_CREDENTIAL = 2
+
+type RelayEndpoint struct {
+	relay_type uint8
+	transport  uint8
+	version    uint8
+	auth       uint8
+	ip         net.IP
+	port       uint16
+}
+
+//可用的中转服务器
+//每个中转地址: 类型(1) 传输协议(1) 协议版本(1) 认证方式(1) ip长度(1) ip 端口(2)
+type RelayInfo struct {
+	endpoints []*RelayEndpoint
+}
+
+func (r *RelayInfo) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	write_relay_endpoints(buffer, r.endpoints)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *RelayInfo) FromData(buff []byte) bool {
+	if len(buff) < 1 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	endpoints, ok := read_relay_endpoints(buffer)
+	r.endpoints = endpoints
+	return ok
+}
+
+//通话接通后服务器为双方选择的中转服务器
+type VOIPRelay struct {
+	sender    int64
+	receiver  int64
+	endpoints []*RelayEndpoint
+}
+
+func (r *VOIPRelay) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.sender)
+	binary.Write(buffer, binary.BigEndian, r.receiver)
+	write_relay_endpoints(buffer, r.endpoints)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *VOIPRelay) FromData(buff []byte) bool {
+	if len(buff) < 17 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.sender)
+	binary.Read(buffer, binary.BigEndian, &r.receiver)
+	endpoints, ok := read_relay_endpoints(buffer)
+	r.endpoints = endpoints
+	return ok
+}
+
+//服务器拒绝了呼叫, 呼叫没有发送给被叫
+type VOIPReject struct {
+	receiver int64
+	reason   uint8
+}
+
+func (r *VOIPReject) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, r.receiver)
+	buffer.WriteByte(r.reason)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (r *VOIPReject) FromData(buff []byte) bool {
+	if len(buff) < 9 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &r.receiver)
+	r.reason, _ = buffer.ReadByte()
+	return true
+}
+
+func write_relay_endpoints(buffer *bytes.Buffer, endpoints []*RelayEndpoint) {
+	buffer.WriteByte(byte(len(endpoints)))
+	for _, e := range endpoints {
+		ip := e.ip.To4()
+		if ip == nil {
+			ip = e.ip.To16()
+		}
+		buffer.WriteByte(e.relay_type)
+		buffer.WriteByte(e.transport)
+		buffer.WriteByte(e.version)
+		buffer.WriteByte(e.auth)
+		buffer.WriteByte(byte(len(ip)))
+		buffer.Write(ip)
+		binary.Write(buffer, binary.BigEndian, e.port)
+	}
+}
+
+func read_relay_endpoints(buffer *bytes.Buffer) ([]*RelayEndpoint, bool) {
+	count, err := buffer.ReadByte()
+	if err != nil {
+		return nil, false
+	}
+	endpoints := make([]*RelayEndpoint, 0, count)
+	for i := 0; i < int(count); i++ {
+		if buffer.Len() < 5 {
+			return nil, false
+		}
+		e := new(RelayEndpoint)
+		e.relay_type, _ = buffer.ReadByte()
+		e.transport, _ = buffer.ReadByte()
+		e.version, _ = buffer.ReadByte()
+		e.auth, _ = buffer.ReadByte()
+		l, _ := buffer.ReadByte()
+		if (l != 4 && l != 16) || buffer.Len() < int(l)+2 {
+			return nil, false
+		}
+		e.ip = net.IP(append([]byte(nil), buffer.Next(int(l))...))
+		binary.Read(buffer, binary.BigEndian, &e.port)
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, true
+}
+
 type Authentication struct {
 	uid         int64
 }
@@ -278,26 +519,91 @@ func (auth *AuthenticationToken) FromData(buff []byte) bool {
 type AuthenticationStatus struct {
 	status int32
 	ip     int32 //主机公网ip
+	//版本1: 所有的中转地址, 包括ipv6
+	relay_addrs []*net.UDPAddr
 }
 
-func (auth *AuthenticationStatus) ToData() []byte {
+//版本1: status(4) ip(4) count(1) [ip长度(1) ip 端口(2)]...
+func (auth *AuthenticationStatus) ToData(version int) []byte {
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, auth.status)
 	binary.Write(buffer, binary.BigEndian, auth.ip)
+	if version >= 1 {
+		write_udp_addrs(buffer, auth.relay_addrs)
+	}
 	buf := buffer.Bytes()
 	return buf
 }
 
-func (auth *AuthenticationStatus) FromData(buff []byte) bool {
+func (auth *AuthenticationStatus) FromData(version int, buff []byte) bool {
 	if len(buff) < 8 {
 		return false
 	}
 	buffer := bytes.NewBuffer(buff)
 	binary.Read(buffer, binary.BigEndian, &auth.status)
 	binary.Read(buffer, binary.BigEndian, &auth.ip)
+	if version >= 1 && buffer.Len() > 0 {
+		addrs, ok := read_udp_addrs(buffer)
+		if !ok {
+			return false
+		}
+		auth.relay_addrs = addrs
+	}
 	return true
 }
 
+func write_udp_addrs(buffer *bytes.Buffer, addrs []*net.UDPAddr) {
+	buffer.WriteByte(byte(len(addrs)))
+	for _, addr := range addrs {
+		ip := addr.IP.To4()
+		if ip == nil {
+			ip = addr.IP.To16()
+		}
+		buffer.WriteByte(byte(len(ip)))
+		buffer.Write(ip)
+		binary.Write(buffer, binary.BigEndian, uint16(addr.Port))
+	}
+}
+
+func read_udp_addrs(buffer *bytes.Buffer) ([]*net.UDPAddr, bool) {
+	count, err := buffer.ReadByte()
+	if err != nil {
+		return nil, false
+	}
+	addrs := make([]*net.UDPAddr, 0, count)
+	for i := 0; i < int(count); i++ {
+		l, err := buffer.ReadByte()
+		if err != nil || (l != 4 && l != 16) || buffer.Len() < int(l)+2 {
+			return nil, false
+		}
+		ip := net.IP(append([]byte(nil), buffer.Next(int(l))...))
+		var port uint16
+		binary.Read(buffer, binary.BigEndian, &port)
+		addrs = append(addrs, &net.UDPAddr{IP:ip, Port:int(port)})
+	}
+	return addrs, true
+}
+
+//服务器即将关闭, 客户端在delay秒内重连到其它服务器
+type ReconnectHint struct {
+	delay int32
+}
+
+func (hint *ReconnectHint) ToData() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, hint.delay)
+	buf := buffer.Bytes()
+	return buf
+}
+
+func (hint *ReconnectHint) FromData(buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	buffer := bytes.NewBuffer(buff)
+	binary.Read(buffer, binary.BigEndian, &hint.delay)
+	return true
+}
 
 func SendMessage(conn io.Writer, msg *Message) error {
 	body := msg.ToData()
@@ -0,0 +1,84 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "sync"
+import "time"
+
+type TokenBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+//按key(如客户端ip)限速, 每秒rate个, 最多累积burst个
+type RateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*TokenBucket
+	gc_ts   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.buckets = make(map[string]*TokenBucket)
+	limiter.gc_ts = time.Now()
+	return limiter
+}
+
+//rate<=0表示不限速
+func (limiter *RateLimiter) Allow(key string, rate int, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &TokenBucket{tokens:float64(burst), ts:now}
+		limiter.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.ts).Seconds() * float64(rate)
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.ts = now
+	}
+
+	//桶满之后就可以删除
+	if now.Sub(limiter.gc_ts) > time.Minute {
+		for k, v := range limiter.buckets {
+			if now.Sub(v.ts) > time.Minute {
+				delete(limiter.buckets, k)
+			}
+		}
+		limiter.gc_ts = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
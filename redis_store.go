@@ -0,0 +1,489 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "fmt"
+import "sync"
+import "time"
+import "errors"
+import "strings"
+import "strconv"
+import "sync/atomic"
+import "github.com/garyburd/redigo/redis"
+import log "github.com/golang/glog"
+
+const REDIS_CLUSTER_SLOTS = 16384
+const REDIS_MAX_REDIRECTS = 5
+
+//token和推送队列的存储, 单机, sentinel, cluster三种模式
+type RedisStore interface {
+	//args[0]是key, cluster模式下按key路由
+	Do(cmd string, args ...interface{}) (interface{}, error)
+	//用于订阅的连接, 调用者负责关闭
+	PubSubConn() (redis.Conn, error)
+}
+
+var redis_store RedisStore
+
+func NewRedisStore(config *Config) RedisStore {
+	if len(config.redis_cluster_addresses) > 0 {
+		log.Infof("redis cluster:%s", strings.Join(config.redis_cluster_addresses, ","))
+		return NewClusterStore(config.redis_cluster_addresses, config.redis_password)
+	}
+	if len(config.redis_sentinels) > 0 {
+		log.Infof("redis sentinel:%s master:%s",
+			strings.Join(config.redis_sentinels, ","), config.redis_master_name)
+		sentinel := NewSentinel(config.redis_sentinels, config.redis_master_name,
+			config.redis_sentinel_password)
+		go sentinel.Watch()
+		pool := NewSentinelPool(sentinel, config.redis_password, config.redis_db)
+		password, db := config.redis_password, config.redis_db
+		dial := func() (redis.Conn, error) {
+			addr, err := sentinel.MasterAddress()
+			if err != nil {
+				return nil, err
+			}
+			return dial_redis_subscriber(addr, password, db)
+		}
+		return &PoolStore{pool:pool, sentinel:sentinel, dial_subscriber:dial}
+	}
+	pool := NewRedisPool(config.redis_address, config.redis_password, config.redis_db)
+	address, password, db := config.redis_address, config.redis_password, config.redis_db
+	dial := func() (redis.Conn, error) {
+		return dial_redis_subscriber(address, password, db)
+	}
+	return &PoolStore{pool:pool, dial_subscriber:dial}
+}
+
+func dial_redis(server, password string, db int) (redis.Conn, error) {
+	timeout := time.Duration(config.redis_timeout) * time.Millisecond
+	return dial_redis_timeout(server, password, db, timeout)
+}
+
+//订阅的连接长时间没有消息, 不能设置读超时
+func dial_redis_subscriber(server, password string, db int) (redis.Conn, error) {
+	return dial_redis_timeout(server, password, db, 0)
+}
+
+func dial_redis_timeout(server, password string, db int, read_timeout time.Duration) (redis.Conn, error) {
+	timeout := time.Duration(config.redis_timeout) * time.Millisecond
+	c, err := redis.DialTimeout("tcp", server, timeout, read_timeout, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) > 0 {
+		if _, err := c.Do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db > 0 {
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type PoolStore struct {
+	pool     *redis.Pool
+	sentinel *Sentinel
+	dial_subscriber func() (redis.Conn, error)
+}
+
+func (store *PoolStore) Do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	reply, err := conn.Do(cmd, args...)
+	if e, ok := err.(redis.Error); ok && store.sentinel != nil &&
+		strings.HasPrefix(string(e), "READONLY") {
+		//连接到的master已经降级为slave
+		store.sentinel.Invalidate()
+	}
+	return reply, err
+}
+
+func (store *PoolStore) PubSubConn() (redis.Conn, error) {
+	return store.dial_subscriber()
+}
+
+type Sentinel struct {
+	mutex       sync.Mutex
+	addresses   []string
+	master_name string
+	password    string
+	//每次主从切换加1, 旧的连接不再使用
+	generation  int64
+}
+
+func NewSentinel(addresses []string, master_name string, password string) *Sentinel {
+	s := new(Sentinel)
+	s.addresses = append([]string(nil), addresses...)
+	s.master_name = master_name
+	s.password = password
+	return s
+}
+
+func (s *Sentinel) Generation() int64 {
+	return atomic.LoadInt64(&s.generation)
+}
+
+func (s *Sentinel) Invalidate() {
+	atomic.AddInt64(&s.generation, 1)
+}
+
+//依次询问sentinel, 成功的sentinel移到最前面
+func (s *Sentinel) MasterAddress() (string, error) {
+	s.mutex.Lock()
+	addresses := append([]string(nil), s.addresses...)
+	s.mutex.Unlock()
+
+	for i, addr := range addresses {
+		c, err := dial_redis(addr, s.password, 0)
+		if err != nil {
+			log.Warningf("dial sentinel:%s err:%s", addr, err)
+			continue
+		}
+		reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.master_name))
+		c.Close()
+		if err != nil || len(reply) != 2 {
+			log.Warningf("sentinel:%s get master:%s err:%v", addr, s.master_name, err)
+			continue
+		}
+		if i > 0 {
+			s.mutex.Lock()
+			for j, a := range s.addresses {
+				if a == addr {
+					s.addresses[0], s.addresses[j] = s.addresses[j], s.addresses[0]
+					break
+				}
+			}
+			s.mutex.Unlock()
+		}
+		return reply[0] + ":" + reply[1], nil
+	}
+	return "", errors.New("no sentinel available")
+}
+
+//订阅+switch-master, 主从切换后重新获取master地址
+func (s *Sentinel) Watch() {
+	for {
+		s.mutex.Lock()
+		addr := s.addresses[0]
+		s.mutex.Unlock()
+
+		c, err := dial_redis_subscriber(addr, s.password, 0)
+		if err != nil {
+			log.Warningf("dial sentinel:%s err:%s", addr, err)
+			s.rotate()
+			time.Sleep(time.Second)
+			continue
+		}
+		psc := redis.PubSubConn{Conn:c}
+		psc.Subscribe("+switch-master")
+		for {
+			v := psc.Receive()
+			if m, ok := v.(redis.Message); ok {
+				//<master name> <old ip> <old port> <new ip> <new port>
+				fields := strings.Fields(string(m.Data))
+				if len(fields) == 5 && fields[0] == s.master_name {
+					log.Infof("redis master switched %s:%s -> %s:%s",
+						fields[1], fields[2], fields[3], fields[4])
+					s.Invalidate()
+				}
+			} else if e, ok := v.(error); ok {
+				log.Warningf("sentinel:%s subscribe err:%s", addr, e)
+				break
+			}
+		}
+		c.Close()
+		s.rotate()
+		//重连期间可能错过切换消息
+		s.Invalidate()
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *Sentinel) rotate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.addresses) > 1 {
+		s.addresses = append(s.addresses[1:], s.addresses[0])
+	}
+}
+
+type sentinel_conn struct {
+	redis.Conn
+	generation int64
+}
+
+func NewSentinelPool(s *Sentinel, password string, db int) *redis.Pool {
+	pool := new_redis_pool(func() (redis.Conn, error) {
+		generation := s.Generation()
+		addr, err := s.MasterAddress()
+		if err != nil {
+			return nil, err
+		}
+		c, err := dial_redis(addr, password, db)
+		if err != nil {
+			return nil, err
+		}
+		role, err := redis.Values(c.Do("ROLE"))
+		if err != nil || len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master" {
+			c.Close()
+			s.Invalidate()
+			return nil, fmt.Errorf("redis:%s isn't master", addr)
+		}
+		return &sentinel_conn{Conn:c, generation:generation}, nil
+	})
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		if sc, ok := c.(*sentinel_conn); ok && sc.generation != s.Generation() {
+			return errors.New("redis master changed")
+		}
+		return nil
+	}
+	return pool
+}
+
+type ClusterStore struct {
+	mutex    sync.RWMutex
+	seeds    []string
+	password string
+	slots    [REDIS_CLUSTER_SLOTS]string
+	pools    map[string]*redis.Pool
+	refreshing int32
+}
+
+func NewClusterStore(seeds []string, password string) *ClusterStore {
+	store := new(ClusterStore)
+	store.seeds = seeds
+	store.password = password
+	store.pools = make(map[string]*redis.Pool)
+	if err := store.Refresh(); err != nil {
+		log.Warning("refresh redis cluster slots err:", err)
+	}
+	return store
+}
+
+//CRC16/XMODEM, 支持{hash tag}
+func redis_key_slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return int(crc) % REDIS_CLUSTER_SLOTS
+}
+
+func (store *ClusterStore) get_pool(addr string) *redis.Pool {
+	store.mutex.RLock()
+	pool, ok := store.pools[addr]
+	store.mutex.RUnlock()
+	if ok {
+		return pool
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if pool, ok := store.pools[addr]; ok {
+		return pool
+	}
+	password := store.password
+	pool = new_redis_pool(func() (redis.Conn, error) {
+		return dial_redis(addr, password, 0)
+	})
+	store.pools[addr] = pool
+	return pool
+}
+
+//通过CLUSTER SLOTS更新slot到节点的映射
+func (store *ClusterStore) Refresh() error {
+	store.mutex.RLock()
+	nodes := append([]string(nil), store.seeds...)
+	for addr := range store.pools {
+		nodes = append(nodes, addr)
+	}
+	store.mutex.RUnlock()
+
+	var err error
+	for _, addr := range nodes {
+		var reply []interface{}
+		conn := store.get_pool(addr).Get()
+		reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		var slots [REDIS_CLUSTER_SLOTS]string
+		for _, r := range reply {
+			item, _ := redis.Values(r, nil)
+			if len(item) < 3 {
+				continue
+			}
+			start, _ := redis.Int(item[0], nil)
+			end, _ := redis.Int(item[1], nil)
+			master, _ := redis.Values(item[2], nil)
+			if len(master) < 2 || start < 0 || end >= REDIS_CLUSTER_SLOTS {
+				continue
+			}
+			ip, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			node := ip + ":" + strconv.Itoa(port)
+			for i := start; i <= end; i++ {
+				slots[i] = node
+			}
+		}
+		store.mutex.Lock()
+		store.slots = slots
+		store.mutex.Unlock()
+		return nil
+	}
+	if err == nil {
+		err = errors.New("no redis cluster node")
+	}
+	return err
+}
+
+func (store *ClusterStore) refresh_async() {
+	if !atomic.CompareAndSwapInt32(&store.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&store.refreshing, 0)
+		if err := store.Refresh(); err != nil {
+			log.Warning("refresh redis cluster slots err:", err)
+		}
+	}()
+}
+
+//MOVED 3999 127.0.0.1:6381 或者 ASK 3999 127.0.0.1:6381
+func parse_redirect(e redis.Error) (string, int, string) {
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= REDIS_CLUSTER_SLOTS {
+		return "", 0, ""
+	}
+	return fields[0], slot, fields[2]
+}
+
+//cluster的publish消息会广播到所有节点, 任意节点都可以订阅
+func (store *ClusterStore) PubSubConn() (redis.Conn, error) {
+	store.mutex.RLock()
+	nodes := append([]string(nil), store.seeds...)
+	store.mutex.RUnlock()
+
+	var err error
+	for _, addr := range nodes {
+		conn, e := dial_redis_subscriber(addr, store.password, 0)
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+	if err == nil {
+		err = errors.New("no redis cluster node")
+	}
+	return nil, err
+}
+
+func (store *ClusterStore) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("redis cluster command without key")
+	}
+	slot := redis_key_slot(fmt.Sprint(args[0]))
+
+	store.mutex.RLock()
+	addr := store.slots[slot]
+	store.mutex.RUnlock()
+	if addr == "" {
+		if err := store.Refresh(); err != nil {
+			return nil, err
+		}
+		store.mutex.RLock()
+		addr = store.slots[slot]
+		store.mutex.RUnlock()
+		if addr == "" {
+			return nil, fmt.Errorf("redis cluster slot:%d not covered", slot)
+		}
+	}
+
+	asking := false
+	var reply interface{}
+	var err error
+	for i := 0; i < REDIS_MAX_REDIRECTS; i++ {
+		conn := store.get_pool(addr).Get()
+		if asking {
+			conn.Do("ASKING")
+			asking = false
+		}
+		reply, err = conn.Do(cmd, args...)
+		conn.Close()
+		if err == nil {
+			return reply, nil
+		}
+
+		e, ok := err.(redis.Error)
+		if !ok {
+			//网络错误, 节点可能已经下线
+			store.refresh_async()
+			time.Sleep(100 * time.Millisecond)
+			store.mutex.RLock()
+			addr = store.slots[slot]
+			store.mutex.RUnlock()
+			if addr == "" {
+				return nil, err
+			}
+			continue
+		}
+		kind, s, node := parse_redirect(e)
+		if kind == "MOVED" {
+			store.mutex.Lock()
+			store.slots[s] = node
+			store.mutex.Unlock()
+			store.refresh_async()
+			addr = node
+		} else if kind == "ASK" {
+			asking = true
+			addr = node
+		} else if strings.HasPrefix(string(e), "TRYAGAIN") ||
+			strings.HasPrefix(string(e), "CLUSTERDOWN") {
+			time.Sleep(100 * time.Millisecond)
+		} else {
+			return reply, err
+		}
+	}
+	return reply, err
+}
@@ -0,0 +1,242 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "sync"
+import "sync/atomic"
+import "time"
+import "encoding/json"
+import "github.com/garyburd/redigo/redis"
+import log "github.com/golang/glog"
+
+//所有中转服务器的心跳, field为relay_id, value为RelayNode的json
+const RELAY_REGISTRY_KEY = "voip_relays"
+
+//超过3个心跳周期没有更新认为中转服务器不可用
+const RELAY_EXPIRE_HEARTBEATS = 3
+
+type RelayNode struct {
+	ID            string   `json:"id"`
+	Region        string   `json:"region"`
+	IPs           []string `json:"ips"`
+	TunnelPort    int      `json:"tunnel_port"`
+	TCPPort       int      `json:"tcp_port"`
+	TLSPort       int      `json:"tls_port"`
+	TURNPort      int      `json:"turn_port"`
+	Sessions      int      `json:"sessions"`
+	MaxSessions   int      `json:"max_sessions"`
+	//字节/秒
+	Bandwidth     int64    `json:"bandwidth"`
+	MaxBandwidth  int64    `json:"max_bandwidth"`
+	Draining      bool     `json:"draining"`
+	Timestamp     int64    `json:"timestamp"`
+}
+
+func (node *RelayNode) Endpoints() []*RelayEndpoint {
+	endpoints := make([]*RelayEndpoint, 0)
+	for _, s := range node.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		e := relay_endpoints(ip, node.TunnelPort, node.TCPPort, node.TLSPort, node.TURNPort)
+		endpoints = append(endpoints, e...)
+	}
+	return endpoints
+}
+
+//同一个ip上的所有中转方式, 端口为0表示不支持, 按照客户端尝试的顺序排列
+func relay_endpoints(ip net.IP, udp_port, tcp_port, tls_port, turn_port int) []*RelayEndpoint {
+	endpoints := make([]*RelayEndpoint, 0, 4)
+	if udp_port > 0 {
+		e := &RelayEndpoint{relay_type:RELAY_TYPE_TUNNEL, transport:RELAY_TRANSPORT_UDP,
+			version:TUNNEL_VERSION, auth:RELAY_AUTH_TOKEN, ip:ip, port:uint16(udp_port)}
+		endpoints = append(endpoints, e)
+	}
+	if turn_port > 0 {
+		e := &RelayEndpoint{relay_type:RELAY_TYPE_TURN, transport:RELAY_TRANSPORT_UDP,
+			version:0, auth:RELAY_AUTH_TURN_CREDENTIAL, ip:ip, port:uint16(turn_port)}
+		endpoints = append(endpoints, e)
+	}
+	if tcp_port > 0 {
+		e := &RelayEndpoint{relay_type:RELAY_TYPE_TUNNEL, transport:RELAY_TRANSPORT_TCP,
+			version:TUNNEL_VERSION, auth:RELAY_AUTH_TOKEN, ip:ip, port:uint16(tcp_port)}
+		endpoints = append(endpoints, e)
+	}
+	if tls_port > 0 {
+		e := &RelayEndpoint{relay_type:RELAY_TYPE_TUNNEL, transport:RELAY_TRANSPORT_TLS,
+			version:TUNNEL_VERSION, auth:RELAY_AUTH_TOKEN, ip:ip, port:uint16(tls_port)}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+//负载, 会话数和带宽中较高的使用率, 没有上限时为0
+func (node *RelayNode) Load() float64 {
+	load := 0.0
+	if node.MaxSessions > 0 {
+		load = float64(node.Sessions) / float64(node.MaxSessions)
+	}
+	if node.MaxBandwidth > 0 {
+		if l := float64(node.Bandwidth) / float64(node.MaxBandwidth); l > load {
+			load = l
+		}
+	}
+	return load
+}
+
+func (node *RelayNode) IsFull() bool {
+	return (node.MaxSessions > 0 && node.Sessions >= node.MaxSessions) ||
+		(node.MaxBandwidth > 0 && node.Bandwidth >= node.MaxBandwidth)
+}
+
+//通过redis发现所有中转服务器, 通话接通时为双方选择中转服务器
+type RelayRegistry struct {
+	mutex sync.Mutex
+	nodes map[string]*RelayNode
+}
+
+var relay_registry *RelayRegistry
+
+func NewRelayRegistry() *RelayRegistry {
+	registry := new(RelayRegistry)
+	registry.nodes = make(map[string]*RelayNode)
+	return registry
+}
+
+func (registry *RelayRegistry) Refresh() error {
+	reply, err := redis.StringMap(redis_store.Do("HGETALL", RELAY_REGISTRY_KEY))
+	if err != nil {
+		return err
+	}
+
+	cfg := GetConfig()
+	now := time.Now().Unix()
+	expire := int64(cfg.relay_heartbeat_interval * RELAY_EXPIRE_HEARTBEATS)
+	nodes := make(map[string]*RelayNode)
+	for id, value := range reply {
+		node := new(RelayNode)
+		if err := json.Unmarshal([]byte(value), node); err != nil {
+			log.Warningf("invalid relay node:%s err:%s", id, err)
+			continue
+		}
+		if now - node.Timestamp > expire {
+			relay_stats.Add("expired", 1)
+			//清理已经下线的中转服务器
+			redis_store.Do("HDEL", RELAY_REGISTRY_KEY, id)
+			continue
+		}
+		nodes[id] = node
+	}
+
+	registry.mutex.Lock()
+	registry.nodes = nodes
+	registry.mutex.Unlock()
+	return nil
+}
+
+//优先选择和通话双方在同一区域的中转服务器, 然后选择负载最低的
+func (registry *RelayRegistry) Select(region1 string, region2 string) *RelayNode {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	var selected *RelayNode
+	best_distance := 0
+	best_load := 0.0
+	for _, node := range registry.nodes {
+		if node.Draining || node.IsFull() || len(node.IPs) == 0 {
+			continue
+		}
+		distance := 2
+		if region1 != "" && node.Region == region1 {
+			distance--
+		}
+		if region2 != "" && node.Region == region2 {
+			distance--
+		}
+		load := node.Load()
+		if selected == nil || distance < best_distance ||
+			(distance == best_distance && load < best_load) {
+			selected = node
+			best_distance = distance
+			best_load = load
+		}
+	}
+	if selected != nil {
+		//下次心跳之前避免所有的通话都选择同一个中转服务器
+		selected.Sessions += 2
+	}
+	return selected
+}
+
+func (registry *RelayRegistry) Run() {
+	for {
+		err := registry.Refresh()
+		if err != nil {
+			log.Warning("refresh relay registry err:", err)
+		}
+		time.Sleep(time.Duration(GetConfig().relay_heartbeat_interval) * time.Second)
+	}
+}
+
+//把本服务器的中转负载写到redis
+func RelayHeartbeat(relay_id string) {
+	var last_bytes int64
+	last_ts := time.Now()
+	for {
+		cfg := GetConfig()
+		interval := time.Duration(cfg.relay_heartbeat_interval) * time.Second
+		time.Sleep(interval)
+
+		now := time.Now()
+		bytes := atomic.LoadInt64(&tunnel.bytes)
+		elapsed := now.Sub(last_ts).Seconds()
+		bandwidth := int64(0)
+		if elapsed > 0 {
+			bandwidth = int64(float64(bytes - last_bytes) / elapsed)
+		}
+		last_bytes = bytes
+		last_ts = now
+
+		node := &RelayNode{ID:relay_id, Region:cfg.relay_region, TunnelPort:config.tunnel_port_v2}
+		for _, ip := range config.tunnel_advertised_ips {
+			node.IPs = append(node.IPs, ip.String())
+		}
+		node.TCPPort = config.tunnel_tcp_port
+		node.TLSPort = config.tunnel_tls_port
+		node.TURNPort = config.turn_port
+		node.Sessions = tunnel.ActiveClientCount(int64(cfg.voip_client_timeout))
+		node.MaxSessions = cfg.relay_max_sessions
+		node.Bandwidth = bandwidth
+		node.MaxBandwidth = cfg.relay_max_bandwidth
+		node.Draining = IsDraining()
+		node.Timestamp = now.Unix()
+
+		b, _ := json.Marshal(node)
+		_, err := redis_store.Do("HSET", RELAY_REGISTRY_KEY, relay_id, b)
+		if err != nil {
+			relay_stats.Add("heartbeat_failures", 1)
+			log.Warning("relay heartbeat err:", err)
+			continue
+		}
+		relay_stats.Add("heartbeats", 1)
+	}
+}
@@ -73,6 +73,19 @@ func (route *Route) FindClientSet(uid int64) ClientSet {
 	}
 }
 
+func (route *Route) GetClients() []*Client {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(route.clients))
+	for _, set := range route.clients {
+		for c := range set {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
 func (route *Route) GetClientUids() map[int64]int32 {
 	return nil
 	// route.mutex.Lock()
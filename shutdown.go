@@ -0,0 +1,120 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "os"
+import "net"
+import "sync"
+import "time"
+import "syscall"
+import "os/signal"
+import "sync/atomic"
+import log "github.com/golang/glog"
+
+//通话结束后最多这么多秒内没有数据转发
+const DRAIN_IDLE_TIMEOUT = 5
+
+var draining int32
+
+var listeners_mutex sync.Mutex
+var listeners map[string]*net.TCPListener = make(map[string]*net.TCPListener)
+
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+func AddListener(addr string, listener *net.TCPListener) {
+	listeners_mutex.Lock()
+	defer listeners_mutex.Unlock()
+	listeners[addr] = listener
+}
+
+func CloseListeners() {
+	listeners_mutex.Lock()
+	defer listeners_mutex.Unlock()
+	for addr, listener := range listeners {
+		listener.Close()
+		delete(listeners, addr)
+	}
+}
+
+func NotifyReconnect() {
+	count := 0
+	for _, route := range app_route.GetRoutes() {
+		for _, c := range route.GetClients() {
+			c.SendReconnectHint()
+			count++
+		}
+	}
+	log.Infof("notify reconnect clients:%d", count)
+}
+
+//停止接受新的连接和认证, 等待正在进行的通话结束
+func Drain() {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	log.Info("drain begin")
+	CloseListeners()
+	NotifyReconnect()
+
+	deadline := time.Now().Add(time.Duration(GetConfig().drain_timeout) * time.Second)
+	for time.Now().Before(deadline) {
+		count := tunnel.ActiveClientCount(DRAIN_IDLE_TIMEOUT)
+		if count == 0 {
+			log.Info("drain completed")
+			return
+		}
+		log.Infof("drain waiting active tunnel clients:%d", count)
+		time.Sleep(time.Second)
+	}
+	log.Warning("drain timeout")
+}
+
+func WaitSignal(cfg_path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	sig := <-ch
+	for sig == syscall.SIGUSR2 || sig == syscall.SIGHUP {
+		log.Info("signal:", sig)
+		if sig == syscall.SIGHUP {
+			ReloadConfig(cfg_path)
+		} else if HotRestart() == nil {
+			//udp socket已经移交给新进程,通知tcp客户端重连
+			atomic.StoreInt32(&draining, 1)
+			CloseListeners()
+			NotifyReconnect()
+			time.Sleep(time.Second)
+			log.Flush()
+			return
+		}
+		sig = <-ch
+	}
+	log.Info("signal:", sig)
+	//再次收到信号时立即退出
+	go func() {
+		<-ch
+		log.Warning("exit without drain")
+		log.Flush()
+		os.Exit(1)
+	}()
+	Drain()
+	log.Flush()
+}
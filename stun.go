@@ -0,0 +1,243 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha1"
+import "hash/crc32"
+import "encoding/binary"
+
+//RFC 5389 STUN, 只处理Binding Request, 客户端用来获取自己的公网地址
+const STUN_MAGIC_COOKIE = 0x2112A442
+const STUN_HEADER_SIZE = 20
+
+const STUN_BINDING_REQUEST = 0x0001
+const STUN_BINDING_RESPONSE = 0x0101
+const STUN_BINDING_ERROR = 0x0111
+
+const STUN_ATTR_MAPPED_ADDRESS = 0x0001
+const STUN_ATTR_USERNAME = 0x0006
+const STUN_ATTR_MESSAGE_INTEGRITY = 0x0008
+const STUN_ATTR_ERROR_CODE = 0x0009
+const STUN_ATTR_UNKNOWN_ATTRIBUTES = 0x000A
+const STUN_ATTR_REALM = 0x0014
+const STUN_ATTR_NONCE = 0x0015
+const STUN_ATTR_XOR_MAPPED_ADDRESS = 0x0020
+const STUN_ATTR_SOFTWARE = 0x8022
+const STUN_ATTR_FINGERPRINT = 0x8028
+
+const STUN_FINGERPRINT_XOR = 0x5354554e
+const STUN_SOFTWARE = "voip_service"
+
+//前两位为0, 包含magic cookie, 长度是4的倍数且和包长度一致
+func IsSTUNMessage(buff []byte) bool {
+	if len(buff) < STUN_HEADER_SIZE || buff[0]&0xC0 != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint32(buff[4:8]) != STUN_MAGIC_COOKIE {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(buff[2:4]))
+	return length%4 == 0 && length+STUN_HEADER_SIZE == len(buff)
+}
+
+type STUNMessage struct {
+	msg_type       uint16
+	transaction_id []byte
+	buffer         *bytes.Buffer
+}
+
+func NewSTUNMessage(msg_type uint16, transaction_id []byte) *STUNMessage {
+	m := &STUNMessage{msg_type:msg_type, transaction_id:transaction_id}
+	m.buffer = new(bytes.Buffer)
+	return m
+}
+
+func (m *STUNMessage) AddAttribute(attr_type uint16, value []byte) {
+	binary.Write(m.buffer, binary.BigEndian, attr_type)
+	binary.Write(m.buffer, binary.BigEndian, uint16(len(value)))
+	m.buffer.Write(value)
+	//4字节对齐
+	for i := len(value); i%4 != 0; i++ {
+		m.buffer.WriteByte(0)
+	}
+}
+
+func (m *STUNMessage) header(length int) []byte {
+	h := make([]byte, STUN_HEADER_SIZE)
+	binary.BigEndian.PutUint16(h[0:2], m.msg_type)
+	binary.BigEndian.PutUint16(h[2:4], uint16(length))
+	binary.BigEndian.PutUint32(h[4:8], STUN_MAGIC_COOKIE)
+	copy(h[8:20], m.transaction_id)
+	return h
+}
+
+func (m *STUNMessage) AddErrorCode(code int, reason string) {
+	v := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	m.AddAttribute(STUN_ATTR_ERROR_CODE, append(v, reason...))
+}
+
+//加上MESSAGE-INTEGRITY和FINGERPRINT
+func (m *STUNMessage) ToDataWithIntegrity(key []byte) []byte {
+	attrs := m.buffer.Bytes()
+	data := append(m.header(len(attrs)+24), attrs...)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	m.AddAttribute(STUN_ATTR_MESSAGE_INTEGRITY, mac.Sum(nil))
+	return m.ToData()
+}
+
+//最后加上FINGERPRINT
+func (m *STUNMessage) ToData() []byte {
+	attrs := m.buffer.Bytes()
+	data := append(m.header(len(attrs)+8), attrs...)
+	crc := crc32.ChecksumIEEE(data) ^ STUN_FINGERPRINT_XOR
+
+	fingerprint := make([]byte, 8)
+	binary.BigEndian.PutUint16(fingerprint[0:2], STUN_ATTR_FINGERPRINT)
+	binary.BigEndian.PutUint16(fingerprint[2:4], 4)
+	binary.BigEndian.PutUint32(fingerprint[4:8], crc)
+	return append(data, fingerprint...)
+}
+
+func stun_mapped_address(addr *net.UDPAddr) []byte {
+	family := byte(0x01)
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = 0x02
+		ip = addr.IP.To16()
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(addr.Port))
+	copy(v[4:], ip)
+	return v
+}
+
+func stun_xor_mapped_address(addr *net.UDPAddr, transaction_id []byte) []byte {
+	v := stun_mapped_address(addr)
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], STUN_MAGIC_COOKIE)
+	copy(key[4:], transaction_id)
+
+	v[2] ^= key[0]
+	v[3] ^= key[1]
+	for i := 4; i < len(v); i++ {
+		v[i] ^= key[i-4]
+	}
+	return v
+}
+
+type STUNAttribute struct {
+	attr_type uint16
+	value     []byte
+	//属性在消息中的偏移
+	offset    int
+}
+
+func ParseSTUNAttributes(buff []byte) []*STUNAttribute {
+	attrs := make([]*STUNAttribute, 0)
+	offset := STUN_HEADER_SIZE
+	for offset+4 <= len(buff) {
+		attr_type := binary.BigEndian.Uint16(buff[offset:offset+2])
+		length := int(binary.BigEndian.Uint16(buff[offset+2:offset+4]))
+		if offset+4+length > len(buff) {
+			break
+		}
+		attr := &STUNAttribute{attr_type:attr_type, value:buff[offset+4:offset+4+length], offset:offset}
+		attrs = append(attrs, attr)
+		offset += 4 + (length+3)&^3
+	}
+	return attrs
+}
+
+func FindSTUNAttribute(attrs []*STUNAttribute, attr_type uint16) *STUNAttribute {
+	for _, attr := range attrs {
+		if attr.attr_type == attr_type {
+			return attr
+		}
+	}
+	return nil
+}
+
+//校验MESSAGE-INTEGRITY, 长度字段需要调整为到MESSAGE-INTEGRITY为止
+func VerifySTUNIntegrity(buff []byte, attr *STUNAttribute, key []byte) bool {
+	if len(attr.value) != sha1.Size {
+		return false
+	}
+	data := make([]byte, attr.offset)
+	copy(data, buff[:attr.offset])
+	binary.BigEndian.PutUint16(data[2:4], uint16(attr.offset-STUN_HEADER_SIZE+24))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), attr.value)
+}
+
+//返回known之外的comprehension-required属性
+func stun_unknown_attributes(attrs []*STUNAttribute, known map[uint16]bool) []uint16 {
+	unknown := make([]uint16, 0)
+	for _, attr := range attrs {
+		if attr.attr_type < 0x8000 && !known[attr.attr_type] {
+			unknown = append(unknown, attr.attr_type)
+		}
+	}
+	return unknown
+}
+
+//420 Unknown Attribute
+func stun_unknown_attributes_error(msg_type uint16, transaction_id []byte, unknown []uint16) *STUNMessage {
+	m := NewSTUNMessage(msg_type, transaction_id)
+	m.AddErrorCode(420, "Unknown Attribute")
+	v := make([]byte, 2*len(unknown))
+	for i, t := range unknown {
+		binary.BigEndian.PutUint16(v[2*i:], t)
+	}
+	m.AddAttribute(STUN_ATTR_UNKNOWN_ATTRIBUTES, v)
+	return m
+}
+
+func (tunnel *Tunnel) HandleSTUN(buff []byte, addr *net.UDPAddr, conn PacketWriter) {
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	if msg_type != STUN_BINDING_REQUEST {
+		stun_stats.Add("ignored", 1)
+		return
+	}
+	HandleSTUNBinding(buff, addr, conn)
+}
+
+func HandleSTUNBinding(buff []byte, addr *net.UDPAddr, conn PacketWriter) {
+	transaction_id := buff[8:20]
+	attrs := ParseSTUNAttributes(buff)
+	if unknown := stun_unknown_attributes(attrs, nil); len(unknown) > 0 {
+		stun_stats.Add("unknown_attributes", 1)
+		m := stun_unknown_attributes_error(STUN_BINDING_ERROR, transaction_id, unknown)
+		conn.WriteTo(m.ToData(), addr)
+		return
+	}
+
+	stun_stats.Add("binding", 1)
+	m := NewSTUNMessage(STUN_BINDING_RESPONSE, transaction_id)
+	m.AddAttribute(STUN_ATTR_XOR_MAPPED_ADDRESS, stun_xor_mapped_address(addr, transaction_id))
+	m.AddAttribute(STUN_ATTR_MAPPED_ADDRESS, stun_mapped_address(addr))
+	m.AddAttribute(STUN_ATTR_SOFTWARE, []byte(STUN_SOFTWARE))
+	conn.WriteTo(m.ToData(), addr)
+}
@@ -24,6 +24,8 @@ import "fmt"
 import "net"
 import "bytes"
 import "sync"
+import "sync/atomic"
+import "net/netip"
 import "errors"
 import "encoding/binary"
 import log "github.com/golang/glog"
@@ -31,77 +33,206 @@ import log "github.com/golang/glog"
 const VOIP_AUTH = 1
 const VOIP_AUTH_STATUS = 2
 const VOIP_DATA = 3
+//ping: 8字节客户端时间戳
+//pong: 8字节客户端时间戳, 2字节端口, 1字节ip长度, 客户端的公网ip
+const VOIP_PING = 4
+const VOIP_PONG = 5
+//app超过配额, 数据被丢弃: 1字节原因(QUOTA_CALLS, QUOTA_BANDWIDTH), 每秒最多通知一次
+const VOIP_QUOTA_EXCEEDED = 6
 
+//RunV2的tunnel协议版本, 通过MSG_RELAY_INFO通知客户端
+const TUNNEL_VERSION = 2
+
+//默认值, 可以通过配置文件修改
 const GC_HZ = 5*60
 const VOIP_CLIENT_TIMEOUT = 1*60
 
+//加入客户端表之后除了timestamp, forward_ts, quota_ts和call都不再修改, 认证成功时创建新的TunnelClient
+//timestamp通过Touch和Timestamp原子访问
 type TunnelClient struct {
+	timestamp int64
+	//最后一次转发数据的时间, ping只刷新timestamp, 关闭时据此判断通话是否结束
+	forward_ts int64
+	//最后一次发送VOIP_QUOTA_EXCEEDED的时间
+	quota_ts  int64
 	appid     int64
 	uid       int64
 	addr      *net.UDPAddr
-	timestamp int64
 	has_header  bool
 	token     string
+	//通过tcp/tls连接的客户端, udp客户端为nil
+	stream    *TunnelStream
+	//app的使用量, 加入客户端表时设置
+	usage     *AppUsage
+	//正在进行的通话(*AppCall), 只在配置了通话数配额时使用
+	call      atomic.Value
+	//创建时计算, 查找和删除时不需要重新计算
+	key       AddrKey
+}
+
+func NewTunnelClient(addr *net.UDPAddr) *TunnelClient {
+	return &TunnelClient{addr:addr, key:addr_key(addr)}
+}
+
+//复制认证前的客户端
+func (client *TunnelClient) Authenticated(appid int64, uid int64) *TunnelClient {
+	c := &TunnelClient{appid:appid, uid:uid, addr:client.addr, has_header:client.has_header,
+		token:client.token, stream:client.stream, key:client.key}
+	c.Touch(time.Now().Unix())
+	return c
+}
+
+func (client *TunnelClient) Touch(now int64) {
+	atomic.StoreInt64(&client.timestamp, now)
+}
+
+func (client *TunnelClient) Timestamp() int64 {
+	return atomic.LoadInt64(&client.timestamp)
+}
+
+func (client *TunnelClient) ForwardTimestamp() int64 {
+	return atomic.LoadInt64(&client.forward_ts)
 }
 
 type TunnelClientSet map[int64]*TunnelClient
 
+//多个读协程并发查找, 按照地址和用户分片减少锁竞争
+const TUNNEL_SHARDS = 64
 
-type Tunnel struct {
+//ipv4地址使用ipv4-mapped ipv6的形式, 作为map的key不需要分配内存
+type AddrKey struct {
+	ip   [16]byte
+	port int
+}
+
+func addr_key(addr *net.UDPAddr) AddrKey {
+	var key AddrKey
+	copy(key.ip[:], addr.IP.To16())
+	key.port = addr.Port
+	return key
+}
+
+//和addr_key相同, ipv4地址的As16也是ipv4-mapped的形式
+func addr_port_key(ap netip.AddrPort) AddrKey {
+	var key AddrKey
+	key.ip = ap.Addr().As16()
+	key.port = int(ap.Port())
+	return key
+}
+
+//fnv-1a
+func (key *AddrKey) shard() int {
+	h := uint32(2166136261)
+	for _, b := range key.ip {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(key.port & 0xff)) * 16777619
+	h = (h ^ uint32(key.port >> 8)) * 16777619
+	return int(h % TUNNEL_SHARDS)
+}
+
+type AddrShard struct {
+	mutex   sync.RWMutex
+	clients map[AddrKey]*TunnelClient
+}
+
+type UserShard struct {
+	mutex       sync.RWMutex
 	app_clients map[int64]TunnelClientSet
-	clients map[int64]*TunnelClient
-	mutex   sync.Mutex
-	gc_ts   int64
+}
+
+type Tunnel struct {
+	//转发的字节数, 64位原子操作需要放在前面
+	bytes int64
+	addr_shards [TUNNEL_SHARDS]*AddrShard
+	user_shards [TUNNEL_SHARDS]*UserShard
+	auth_limiter *RateLimiter
+	//RunV2监听的udp socket, tcp客户端通过它转发给udp客户端
+	udp_conn atomic.Value
+	//在worker协程中调用, 默认为LoadUserAccessTokenCached
+	load_token func(token string) (int64, int64, string, error)
+	//认证的worker协程, 默认为tunnel_auth_pool
+	auth_pool *WorkerPool
+	quotas *AppQuotas
+	//加入和删除客户端时持有, 地址和用户两个索引一起修改, 查找只需要分片的锁
+	mutex sync.Mutex
 }
 
 func NewTunnel() *Tunnel {
 	t := new(Tunnel)
-	t.clients = make(map[int64]*TunnelClient)
-	t.app_clients = make(map[int64]TunnelClientSet)
+	for i := 0; i < TUNNEL_SHARDS; i++ {
+		t.addr_shards[i] = &AddrShard{clients:make(map[AddrKey]*TunnelClient)}
+		t.user_shards[i] = &UserShard{app_clients:make(map[int64]TunnelClientSet)}
+	}
+	t.auth_limiter = NewRateLimiter()
+	t.load_token = LoadUserAccessTokenCached
+	t.auth_pool = tunnel_auth_pool
+	t.quotas = NewAppQuotas()
 	return t
 }
 
 func (tunnel *Tunnel) Start() {
-	go tunnel.Run()
+	if config.legacy_appid != 0 && len(config.legacy_tunnel_address) > 0 {
+		go tunnel.Run()
+	}
 	go tunnel.RunV2()
+	go tunnel.RunGC()
 }
 
+var ErrInvalidVOIPData = errors.New("invalid voip data len")
+
 func (tunnel *Tunnel) ReadVOIPData(buff []byte) (int64, int64, []byte, error) {
 	if len(buff) <= 16 {
 		log.Error("invalid voip data len:", len(buff))
-		return 0, 0, nil, errors.New("invalid voip data len")
+		return 0, 0, nil, ErrInvalidVOIPData
 	}
-	buffer := bytes.NewBuffer(buff)
-	var sender int64
-	var receiver int64
-	binary.Read(buffer, binary.BigEndian, &sender)
-	binary.Read(buffer, binary.BigEndian, &receiver)
-	
+	sender := int64(binary.BigEndian.Uint64(buff[0:8]))
+	receiver := int64(binary.BigEndian.Uint64(buff[8:16]))
 	return sender, receiver, buff[16:], nil
 }
 
 func (tunnel *Tunnel) ReadVOIPAuth(buff []byte) (string, error) {
+	if len(buff) < 2 {
+		return "", errors.New("invalid voip auth len")
+	}
 	buffer := bytes.NewBuffer(buff)
 	var size int16
 	binary.Read(buffer, binary.BigEndian, &size)
+	if size < 0 || int(size) > len(buff)-2 {
+		return "", errors.New("invalid voip auth token len")
+	}
 	token := buff[2:2+size]
 	return string(token), nil
 }
 
-func (tunnel *Tunnel) HandleVOIPData(buff []byte, addr *net.UDPAddr, conn *net.UDPConn) {
+//header为true时pkt包含1字节的header
+func (tunnel *Tunnel) HandleVOIPData(pkt []byte, header bool, addr *net.UDPAddr, conn PacketWriter) {
+	client := tunnel.FindClient(addr)
+	if client == nil {
+		return
+	}
+	tunnel.ForwardVOIPData(client, pkt, header, conn)
+}
+
+//udp和tcp客户端共用app_clients, 可以互相转发
+//转发过程不分配内存, 直接修改pkt中的header, 调用者在写完成之前不能重用pkt
+func (tunnel *Tunnel) ForwardVOIPData(client *TunnelClient, pkt []byte, header bool, conn PacketWriter) {
 	now := time.Now().Unix()
 
+	buff := pkt
+	if header {
+		buff = pkt[1:]
+	}
 	_, receiver, _, err := tunnel.ReadVOIPData(buff)
 	if err != nil {
 		return
 	}
-	
-	client := tunnel.FindClient(addr)
-	if client == nil || client.appid == 0 {
+	if client.appid == 0 {
 		return
 	}
 
-	client.timestamp = now
+	client.Touch(now)
+	atomic.StoreInt64(&client.forward_ts, now)
 	//转发消息
 	other := tunnel.FindAppClient(client.appid, receiver)
 	if other == nil {
@@ -109,111 +240,204 @@ func (tunnel *Tunnel) HandleVOIPData(buff []byte, addr *net.UDPAddr, conn *net.U
 		return
 	}
 
-	if other.has_header {
-		buffer := new(bytes.Buffer)
-		var h byte = VOIP_DATA
-		buffer.WriteByte(h)
-		buffer.Write(buff)
-		data := buffer.Bytes()
-		conn.WriteTo(data, other.addr)
+	if reason := tunnel.check_quota(client, receiver, len(buff), now); reason != 0 {
+		tunnel.SendQuotaExceeded(client, reason, now, conn)
+		return
+	}
+
+	atomic.AddInt64(&tunnel.bytes, int64(len(buff)))
+	if other.has_header && header {
+		pkt[0] = VOIP_DATA
+		tunnel.WriteClient(other, pkt, conn)
+	} else if other.has_header {
+		//旧版本的客户端发送的包没有header
+		data := make([]byte, len(buff)+1)
+		data[0] = VOIP_DATA
+		copy(data[1:], buff)
+		tunnel.WriteClient(other, data, conn)
 	} else {
-		data := buff
-		conn.WriteTo(data, other.addr)
+		tunnel.WriteClient(other, buff, conn)
 	}
 }
 
-func (tunnel *Tunnel) HandleAuth(buff []byte, addr *net.UDPAddr, conn *net.UDPConn) {
+//conn为nil时使用RunV2的udp socket
+func (tunnel *Tunnel) WriteClient(client *TunnelClient, data []byte, conn PacketWriter) {
+	if client.stream != nil {
+		client.stream.Write(data)
+		return
+	}
+	if conn == nil {
+		udp_conn, _ := tunnel.udp_conn.Load().(*net.UDPConn)
+		if udp_conn == nil {
+			return
+		}
+		conn = udp_conn
+	}
+	conn.WriteTo(data, client.addr)
+}
+
+func (tunnel *Tunnel) HandleAuth(buff []byte, addr *net.UDPAddr, conn PacketWriter) {
 	now := time.Now().Unix()
 	token, err := tunnel.ReadVOIPAuth(buff)
 	if err != nil {
 		return
 	}
 	client := tunnel.FindClient(addr)
-	if client == nil {
-		//首次收到认证消息
-		client = &TunnelClient{appid:0, uid:0, addr:addr, timestamp:now, has_header:true, token:token}
-		tunnel.AuthClient(client, token)
-		return
-	} else if client.token == token {
+	if client != nil && client.token == token {
 		//认证成功
-		t := make([]byte, 2)
-		t[0] = VOIP_AUTH_STATUS
-		t[1] = 0
-		conn.WriteTo(t, addr)
-		client.timestamp = now
+		tunnel.SendAuthStatus(AUTH_STATUS_SUCCESS, client, conn)
+		client.Touch(now)
 		log.Infof("tunnel auth appid:%d uid:%d", client.appid, client.uid)
-	} else {
-		//新的token
-		tunnel.RemoveTunnelClient(client)
-		client.token = token
-		client.appid = 0
-		client.uid = 0
-		client.timestamp = now
-		tunnel.AuthClient(client, token)
+		return
 	}
+	if client != nil {
+		//新的token, 认证成功之前不再转发
+		tunnel.EvictClient(client, EVICT_REPLACED)
+	} else if IsDraining() {
+		//关闭中,不再接受新的连接
+		return
+	}
+
+	//认证中的客户端不在客户端表中, 只有worker协程持有
+	client = NewTunnelClient(addr)
+	client.timestamp = now
+	client.has_header = true
+	client.token = token
+	tunnel.AuthClient(client, token, conn)
 }
 
-func (tunnel *Tunnel) Addr2Int64(addr *net.UDPAddr) int64 {
-	ip := addr.IP.To4()
-	if ip == nil {
-		return 0
+func (tunnel *Tunnel) user_shard(appid int64, uid int64) *UserShard {
+	return tunnel.user_shards[uint64(appid ^ uid) % TUNNEL_SHARDS]
+}
+
+func (tunnel *Tunnel) add_addr_client(client *TunnelClient) {
+	shard := tunnel.addr_shards[client.key.shard()]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.clients[client.key] = client
+}
+
+func (tunnel *Tunnel) remove_addr_client(client *TunnelClient) {
+	shard := tunnel.addr_shards[client.key.shard()]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	//同一个地址可能已经有了新的客户端
+	if shard.clients[client.key] == client {
+		delete(shard.clients, client.key)
 	}
-	return (int64(ip[0]) << 24) | (int64(ip[1]) << 16) | (int64(ip[2]) << 8) | int64(ip[3]) | (int64(addr.Port) << 32)
 }
 
-func (tunnel *Tunnel) AddTunnelClient(client *TunnelClient) {
-	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
+//app的tunnel客户端数达到上限时返回false, 已经登录的用户重新登录不受限制
+func (tunnel *Tunnel) AddTunnelClient(client *TunnelClient) bool {
+	_, max_clients, _ := GetConfig().AppQuota(client.appid)
+	return tunnel.add_tunnel_client(client, max_clients)
+}
 
+//max_clients为0时不限制
+func (tunnel *Tunnel) add_tunnel_client(client *TunnelClient, max_clients int) bool {
 	appid := client.appid
 	uid := client.uid
+	usage := tunnel.quotas.Get(appid)
+	if client.usage == nil {
+		client.usage = usage
+	}
 
-	if client_set, ok := tunnel.app_clients[appid]; ok {
-		if old_client, ok := client_set[uid]; ok {
-			//此用户已经登录,删除前一个登陆点
-			iaddr := tunnel.Addr2Int64(old_client.addr)
-			delete(tunnel.clients, iaddr)
-		}		
-	}	
-	iaddr := tunnel.Addr2Int64(client.addr)
-	tunnel.clients[iaddr] = client
-	
-	if client_set, ok := tunnel.app_clients[appid]; ok {
-		client_set[uid] = client
-	} else {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if client.stream == nil {
+		//同一个地址上另一个用户的认证先完成, 先删除它并释放配额, 否则它通过地址已经找不到
+		prev := tunnel.find_client(client.key)
+		if prev != nil && (prev.appid != appid || prev.uid != uid) && tunnel.remove_tunnel_client(prev) {
+			tunnel.OnEvicted(prev, EVICT_REPLACED)
+		}
+	}
+
+	shard := tunnel.user_shard(appid, uid)
+	shard.mutex.Lock()
+	client_set := shard.app_clients[appid]
+	old_client := client_set[uid]
+	if old_client == nil && !usage.AddClient(max_clients) {
+		shard.mutex.Unlock()
+		return false
+	}
+	if client_set == nil {
 		client_set = make(map[int64]*TunnelClient)
-		client_set[uid] = client
-		tunnel.app_clients[appid] = client_set
+		shard.app_clients[appid] = client_set
+	}
+	client_set[uid] = client
+	shard.mutex.Unlock()
+
+	if old_client != nil && old_client != client {
+		//此用户已经登录,删除前一个登陆点
+		if old_client.stream == nil {
+			tunnel.remove_addr_client(old_client)
+		} else if old_client.stream != client.stream {
+			//被替换的tcp连接不能继续转发, 关闭之后它的读协程退出
+			old_client.stream.Close()
+		}
+		tunnel.OnEvicted(old_client, EVICT_REPLACED)
 	}
+	//tcp客户端不通过地址查找
+	if client.stream == nil {
+		tunnel.add_addr_client(client)
+	}
+	return true
 }
 
-func (tunnel *Tunnel) RemoveTunnelClient(client *TunnelClient) {
+//返回false表示客户端已经被删除或者被新的登录点替换
+func (tunnel *Tunnel) RemoveTunnelClient(client *TunnelClient) bool {
 	tunnel.mutex.Lock()
 	defer tunnel.mutex.Unlock()
+	return tunnel.remove_tunnel_client(client)
+}
 
-	iaddr := tunnel.Addr2Int64(client.addr)
-	delete(tunnel.clients, iaddr)
+func (tunnel *Tunnel) remove_tunnel_client(client *TunnelClient) bool {
+	if client.stream == nil {
+		tunnel.remove_addr_client(client)
+	}
 
+	//同一个用户可能已经有了新的登录点
 	appid := client.appid
 	uid := client.uid
-	if client_set, ok := tunnel.app_clients[appid]; ok {
-		delete(client_set, uid)
+	shard := tunnel.user_shard(appid, uid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	client_set, ok := shard.app_clients[appid]
+	if !ok || client_set[uid] != client {
+		return false
+	}
+	delete(client_set, uid)
+	shard.remove_empty_set(appid, client_set)
+	tunnel.quotas.Get(appid).RemoveClient()
+	return true
+}
+
+//app没有在线的客户端时删除, 否则每个出现过的appid都会留下一个空的map
+func (shard *UserShard) remove_empty_set(appid int64, client_set TunnelClientSet) {
+	if len(client_set) == 0 {
+		delete(shard.app_clients, appid)
+		tunnel_gc_stats.Add("empty_sets", 1)
 	}
 }
 
 func (tunnel *Tunnel) FindClient(addr *net.UDPAddr) *TunnelClient {
-	iaddr := tunnel.Addr2Int64(addr)
-	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
+	return tunnel.find_client(addr_key(addr))
+}
+
+func (tunnel *Tunnel) find_client(key AddrKey) *TunnelClient {
+	shard := tunnel.addr_shards[key.shard()]
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 
-	return tunnel.clients[iaddr]
+	return shard.clients[key]
 }
 
 func (tunnel *Tunnel) FindAppClient(appid int64, uid int64) *TunnelClient {
-	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
+	shard := tunnel.user_shard(appid, uid)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 	
-	if client_set, ok := tunnel.app_clients[appid]; ok {
+	if client_set, ok := shard.app_clients[appid]; ok {
 		if client, ok := client_set[uid]; ok {
 			return client
 		}
@@ -221,99 +445,254 @@ func (tunnel *Tunnel) FindAppClient(appid int64, uid int64) *TunnelClient {
 	return nil
 }
 
+//同时删除地址索引, 否则GC扫描不到这个用户
 func (tunnel *Tunnel) RemoveAppClient(appid int64, uid int64) {
 	tunnel.mutex.Lock()
 	defer tunnel.mutex.Unlock()
-	
-	if client_set, ok := tunnel.app_clients[appid]; ok {
-		delete(client_set, uid)
+	if client := tunnel.FindAppClient(appid, uid); client != nil {
+		tunnel.remove_tunnel_client(client)
 	}
 }
 
-func (tunnel *Tunnel) AuthClient(client *TunnelClient, token string) {
-	go func() {
-		appid, uid, _, err := LoadUserAccessToken(token)
+//所有udp客户端
+func (tunnel *Tunnel) UDPClients() []*TunnelClient {
+	clients := make([]*TunnelClient, 0)
+	for _, shard := range tunnel.addr_shards {
+		shard.mutex.RLock()
+		for _, c := range shard.clients {
+			clients = append(clients, c)
+		}
+		shard.mutex.RUnlock()
+	}
+	return clients
+}
+
+//通知发送方数据因为配额被丢弃, 每个客户端每秒最多一次
+func (tunnel *Tunnel) SendQuotaExceeded(client *TunnelClient, reason uint8, now int64, conn PacketWriter) {
+	if !client.has_header {
+		return
+	}
+	ts := atomic.LoadInt64(&client.quota_ts)
+	if ts == now || !atomic.CompareAndSwapInt64(&client.quota_ts, ts, now) {
+		return
+	}
+	log.Infof("app:%d uid:%d quota exceeded:%d", client.appid, client.uid, reason)
+	tunnel.WriteClient(client, []byte{VOIP_QUOTA_EXCEEDED, reason}, conn)
+}
+
+func (tunnel *Tunnel) SendAuthStatus(status byte, client *TunnelClient, conn PacketWriter) {
+	t := make([]byte, 2)
+	t[0] = VOIP_AUTH_STATUS
+	t[1] = status
+	tunnel.WriteClient(client, t, conn)
+}
+
+func (tunnel *Tunnel) AuthClient(client *TunnelClient, token string, conn PacketWriter) {
+	if IsDegraded() && auth_cache == nil {
+		tunnel_auth_stats.Add("unavailable", 1)
+		tunnel.SendAuthStatus(AUTH_STATUS_UNAVAILABLE, client, conn)
+		return
+	}
+	ip := client.addr.IP.String()
+	if !tunnel.auth_limiter.Allow(ip, GetConfig().tunnel_auth_rate, GetConfig().tunnel_auth_burst) {
+		tunnel_auth_stats.Add("rate_limited", 1)
+		tunnel.SendAuthStatus(AUTH_STATUS_RATE_LIMITED, client, conn)
+		return
+	}
+	//在worker协程中回复, 不能使用读协程的批量发送
+	conn = Unbatched(conn)
+	r := tunnel.auth_pool.Submit(func() {
+		appid, uid, _, err := tunnel.load_token(token)
 		if err != nil {
-			log.Warning("auth token err:", err)
+			log.Warningf("auth token addr:%s err:%s", client.addr, err)
+			status := auth_error_status(err)
+			tunnel_auth_stats.Add(auth_status_name(status), 1)
+			tunnel.SendAuthStatus(status, client, conn)
 			return
 		}
+		if appid == 0 || uid == 0 {
+			log.Warningf("auth token addr:%s appid==0, uid==0", client.addr)
+			tunnel_auth_stats.Add("invalid_token", 1)
+			tunnel.SendAuthStatus(AUTH_STATUS_INVALID_TOKEN, client, conn)
+			return
+		}
+		tunnel_auth_stats.Add("success", 1)
 
-		client.appid = appid
-		client.uid = uid
 		log.Infof("auth client:%d", uid)
-		tunnel.AddTunnelClient(client)
-	}()
+		authed := client.Authenticated(appid, uid)
+		var added bool
+		if client.stream != nil {
+			added = tunnel.AddStreamClient(client, authed)
+		} else {
+			added = tunnel.AddTunnelClient(authed)
+		}
+		if !added {
+			tunnel_auth_stats.Add("quota_exceeded", 1)
+			tunnel.SendAuthStatus(AUTH_STATUS_QUOTA_EXCEEDED, client, conn)
+		}
+	})
+	if !r {
+		tunnel_auth_stats.Add("busy", 1)
+		tunnel.SendAuthStatus(AUTH_STATUS_BUSY, client, conn)
+	}
 }
 
+func auth_error_status(err error) byte {
+	switch err {
+	case ErrTokenNonExists:
+		return AUTH_STATUS_INVALID_TOKEN
+	case ErrTokenExpired:
+		return AUTH_STATUS_EXPIRED
+	case ErrRedisUnavailable:
+		return AUTH_STATUS_UNAVAILABLE
+	default:
+		return AUTH_STATUS_FAILURE
+	}
+}
 
-func (tunnel *Tunnel) GC() {
-	now := time.Now().Unix()
-	if now - tunnel.gc_ts < GC_HZ {
-		return
+func auth_status_name(status byte) string {
+	switch status {
+	case AUTH_STATUS_SUCCESS:
+		return "success"
+	case AUTH_STATUS_UNAVAILABLE:
+		return "unavailable"
+	case AUTH_STATUS_INVALID_TOKEN:
+		return "invalid_token"
+	case AUTH_STATUS_EXPIRED:
+		return "expired"
+	case AUTH_STATUS_BUSY:
+		return "busy"
+	case AUTH_STATUS_RATE_LIMITED:
+		return "rate_limited"
+	case AUTH_STATUS_QUOTA_EXCEEDED:
+		return "quota_exceeded"
+	default:
+		return "failure"
 	}
+}
 
-	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
 
-	for k, c := range tunnel.clients {
-		if now-c.timestamp > VOIP_CLIENT_TIMEOUT {
-			delete(tunnel.clients, k)
-			if s, ok := tunnel.app_clients[c.appid]; ok {
-				delete(s, c.uid)
+//最近active秒内有数据转发的客户端数
+func (tunnel *Tunnel) ActiveClientCount(active int64) int {
+	now := time.Now().Unix()
+
+	//包括tcp客户端
+	count := 0
+	for _, shard := range tunnel.user_shards {
+		shard.mutex.RLock()
+		for _, s := range shard.app_clients {
+			for _, c := range s {
+				if now-c.ForwardTimestamp() <= active {
+					count++
+				}
 			}
-			log.Infof("client gc:%d", c.uid)
 		}
+		shard.mutex.RUnlock()
 	}
-	tunnel.gc_ts = now
+	return count
 }
 
+//刷新客户端的活跃时间, 回显客户端的时间戳用于计算rtt, 同时告知客户端的公网地址
+//pong比ping大, 只回复已经认证的客户端, 避免被伪造源地址用来放大流量
+func (tunnel *Tunnel) HandlePing(buff []byte, addr *net.UDPAddr, conn PacketWriter) {
+	if len(buff) < 8 {
+		return
+	}
 
-func (tunnel *Tunnel) HandleData(buff []byte, addr *net.UDPAddr, conn *net.UDPConn) {
+	client := tunnel.FindClient(addr)
+	if client == nil {
+		return
+	}
+	client.Touch(time.Now().Unix())
+	conn.WriteTo(tunnel.PongData(buff, addr), addr)
+}
+
+func (tunnel *Tunnel) PongData(buff []byte, addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(VOIP_PONG)
+	buffer.Write(buff[:8])
+	binary.Write(buffer, binary.BigEndian, uint16(addr.Port))
+	buffer.WriteByte(byte(len(ip)))
+	buffer.Write(ip)
+	return buffer.Bytes()
+}
+
+func (tunnel *Tunnel) HandleData(buff []byte, addr *net.UDPAddr, conn PacketWriter) {
+	if len(buff) == 0 {
+		return
+	}
+	if IsSTUNMessage(buff) {
+		tunnel.HandleSTUN(buff, addr, conn)
+		return
+	}
 	h := buff[0]
 	cmd := h&0x0f
 	if cmd == VOIP_AUTH {
 		tunnel.HandleAuth(buff[1:], addr, conn)
 	} else if cmd == VOIP_DATA {
-		tunnel.HandleVOIPData(buff[1:], addr, conn)
+		tunnel.HandleVOIPData(buff, true, addr, conn)
+	} else if cmd == VOIP_PING {
+		tunnel.HandlePing(buff[1:], addr, conn)
 	}
 }
 
 func (tunnel *Tunnel) RunV2() {
 
 	addr := fmt.Sprintf(":%d", config.tunnel_port_v2)
-	laddr, err := net.ResolveUDPAddr("udp", addr)
+	conns, err := ListenUDPReusePort(addr, config.TunnelReaders())
 	if err != nil {
-		log.Fatal("resolve udp addr err:", err)
+		log.Fatal("listen upd err:", err)
 	}
+	tunnel.udp_conn.Store(conns[0])
 
-	conn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Fatal("listen upd err:", err)
+	for _, conn := range conns[1:] {
+		go tunnel.read_loop(conn)
+	}
+	tunnel.read_loop(conns[0])
+}
+
+//VOIP_DATA不需要创建UDPAddr, 其它的包使用HandleData
+func (tunnel *Tunnel) HandlePacket(buff []byte, ap netip.AddrPort, conn PacketWriter) {
+	if len(buff) > 0 && buff[0]&0x0f == VOIP_DATA && !IsSTUNMessage(buff) {
+		client := tunnel.find_client(addr_port_key(ap))
+		if client != nil {
+			tunnel.ForwardVOIPData(client, buff, true, conn)
+		}
+		return
+	}
+	tunnel.HandleData(buff, net.UDPAddrFromAddrPort(ap), conn)
+}
+
+//每个socket一个读协程
+func (tunnel *Tunnel) read_loop(conn *net.UDPConn) {
+	if size := config.tunnel_batch_size; size > 1 {
+		tunnel.RunBatch(conn, size)
+		return
 	}
 
 	buff := make([]byte, 64*1024)
 	for {
-		n, raddr, err := conn.ReadFromUDP(buff)
+		n, ap, err := conn.ReadFromUDPAddrPort(buff)
 		if err != nil {
+			if reader_gate.IsPaused() {
+				reader_gate.Wait()
+				continue
+			}
 			log.Warning("read udp err:", err)
 			continue
 		}
 
-		tunnel.HandleData(buff[:n], raddr, conn)
-
-		tunnel.GC()
+		tunnel.HandlePacket(buff[:n], ap, conn)
 	}
 }
 
-//兼容旧版本电话虫
+//兼容旧版本电话虫, 发送方uid不经过认证, 只接受legacy_allow_ips内的地址
 func (tunnel *Tunnel) Run() {
-	addr := fmt.Sprintf(":%d", config.tunnel_port)
-	laddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		log.Fatal("resolve udp addr err:", err)
-	}
-
-	conn, err := net.ListenUDP("udp", laddr)
+	conn, err := ListenUDP(config.legacy_tunnel_address)
 	if err != nil {
 		log.Fatal("listen upd err:", err)
 	}
@@ -323,22 +702,41 @@ func (tunnel *Tunnel) Run() {
 	for {
 		n, raddr, err := conn.ReadFromUDP(buff)
 		if err != nil {
+			if reader_gate.IsPaused() {
+				reader_gate.Wait()
+				continue
+			}
 			log.Warning("read udp err:", err)
 			continue
 		}
 		now := time.Now().Unix()
 
-		sender, _, _, _ := tunnel.ReadVOIPData(buff[:n])
-		appid := int64(1006)
+		sender, _, _, err := tunnel.ReadVOIPData(buff[:n])
+		if err != nil {
+			continue
+		}
+		appid := config.legacy_appid
 		client := tunnel.FindClient(raddr)
 		if client == nil {
-			client = &TunnelClient{appid:appid, uid:sender, addr:raddr, timestamp:now, has_header:false}
+			if IsDraining() {
+				continue
+			}
+			if !GetConfig().IsLegacyIPAllowed(raddr.IP) {
+				legacy_auth_stats.Add("udp_rejected", 1)
+				log.Warningf("legacy tunnel rejected uid:%d addr:%s", sender, raddr)
+				continue
+			}
+			legacy_auth_stats.Add("udp_accepted", 1)
+			log.Warningf("deprecated legacy tunnel appid:%d uid:%d addr:%s", appid, sender, raddr)
+			client = NewTunnelClient(raddr)
+			client.appid = appid
+			client.uid = sender
+			client.timestamp = now
 			tunnel.AddTunnelClient(client)
 		} else {
-			client.timestamp = now
+			client.Touch(now)
 		}
 
-		tunnel.HandleVOIPData(buff[:n], raddr, conn)
-		tunnel.GC()
+		tunnel.HandleVOIPData(buff[:n], false, raddr, conn)
 	}
 }
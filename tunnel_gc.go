@@ -0,0 +1,126 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "time"
+import "encoding/json"
+import log "github.com/golang/glog"
+
+//客户端被删除的原因
+const EVICT_TIMEOUT = "timeout"
+//同一个用户在其它地址登录或者更换了token
+const EVICT_REPLACED = "replaced"
+//tcp连接断开
+const EVICT_CLOSED = "closed"
+
+//rpush到tunnel_eviction_queue, 可以用于生成通话记录
+type EvictionEvent struct {
+	Appid     int64  `json:"appid"`
+	Uid       int64  `json:"uid"`
+	Addr      string `json:"addr"`
+	Transport string `json:"transport"`
+	Reason    string `json:"reason"`
+	//最后一次收到数据的时间
+	Timestamp int64  `json:"timestamp"`
+	EvictedAt int64  `json:"evicted_at"`
+}
+
+//不阻塞调用者, 队列满时丢弃
+func (tunnel *Tunnel) OnEvicted(client *TunnelClient, reason string) {
+	tunnel_gc_stats.Add("evicted_" + reason, 1)
+	log.Infof("tunnel client evicted appid:%d uid:%d reason:%s", client.appid, client.uid, reason)
+
+	queue_name := GetConfig().tunnel_eviction_queue
+	if len(queue_name) == 0 || push_pool == nil {
+		return
+	}
+	e := &EvictionEvent{Appid:client.appid, Uid:client.uid, Addr:client.addr.String(),
+		Transport:"udp", Reason:reason, Timestamp:client.Timestamp(), EvictedAt:time.Now().Unix()}
+	if client.stream != nil {
+		e.Transport = "tcp"
+	}
+	b, _ := json.Marshal(e)
+	r := push_pool.Submit(func() {
+		_, err := redis_store.Do("RPUSH", queue_name, b)
+		if err != nil {
+			log.Warning("push eviction event err:", err)
+		}
+	})
+	if !r {
+		tunnel_gc_stats.Add("events_dropped", 1)
+	}
+}
+
+func (tunnel *Tunnel) EvictClient(client *TunnelClient, reason string) {
+	if tunnel.RemoveTunnelClient(client) {
+		tunnel.OnEvicted(client, reason)
+	}
+}
+
+//每次只清理一个分片, 转发时最多等待一个分片的扫描, 所有分片每gc_hz秒清理一次
+//每清理一个分片后也清理没有数据的通话(gc_hz较小, 分片间隔不到1秒时每秒最多一次),
+//避免通话结束后仍然占用app的通话数, 默认配置下每个分片间隔都会执行
+func (tunnel *Tunnel) RunGC() {
+	index := 0
+	var calls_ts int64
+	for {
+		interval := time.Duration(GetConfig().gc_hz) * time.Second / TUNNEL_SHARDS
+		time.Sleep(interval)
+		now := time.Now().Unix()
+		tunnel.sweep(tunnel.addr_shards[index], now)
+		index = (index + 1) % TUNNEL_SHARDS
+		if now != calls_ts {
+			tunnel.quotas.ExpireCalls(now)
+			calls_ts = now
+		}
+	}
+}
+
+//清理所有分片
+func (tunnel *Tunnel) collect(now int64) {
+	for _, shard := range tunnel.addr_shards {
+		tunnel.sweep(shard, now)
+	}
+	tunnel.quotas.ExpireCalls(now)
+}
+
+//删除超时的udp客户端, tcp客户端在连接断开时删除
+func (tunnel *Tunnel) sweep(shard *AddrShard, now int64) {
+	cfg := GetConfig()
+	var expired []*TunnelClient
+	shard.mutex.RLock()
+	for _, c := range shard.clients {
+		timeout := int64(cfg.GetAppConfig(c.appid).voip_client_timeout)
+		if now-c.Timestamp() > timeout {
+			expired = append(expired, c)
+		}
+	}
+	shard.mutex.RUnlock()
+	tunnel_gc_stats.Add("sweeps", 1)
+
+	for _, c := range expired {
+		//扫描之后可能又收到了数据
+		timeout := int64(cfg.GetAppConfig(c.appid).voip_client_timeout)
+		if now-c.Timestamp() <= timeout {
+			continue
+		}
+		tunnel.EvictClient(c, EVICT_TIMEOUT)
+	}
+}
@@ -0,0 +1,74 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "time"
+import "testing"
+
+func app_client_sets(tunnel *Tunnel) int {
+	n := 0
+	for _, shard := range tunnel.user_shards {
+		shard.mutex.RLock()
+		n += len(shard.app_clients)
+		shard.mutex.RUnlock()
+	}
+	return n
+}
+
+//GC只扫描地址分片, 更换token和重新登录之后也不能留下扫描不到的用户
+func TestGCRemovesAppClients(t *testing.T) {
+	tunnel := NewTunnel()
+	tunnel.load_token = race_test_token
+	tunnel.auth_pool = NewWorkerPool("tunnel_auth_test", 0, 64)
+	var w discard_writer
+	for i := 0; i < 4; i++ {
+		for uid := int64(1); uid <= 4; uid++ {
+			addr := &net.UDPAddr{IP:net.IPv4(10, 0, 0, byte(i)), Port:40000 + int(uid)%2}
+			tunnel.HandleData(race_test_auth(uid), addr, w)
+		}
+		for len(tunnel.auth_pool.tasks) > 0 {
+			(<-tunnel.auth_pool.tasks)()
+		}
+		check_tunnel_clients(t, tunnel)
+	}
+
+	timeout := int64(GetConfig().voip_client_timeout)
+	tunnel.collect(time.Now().Unix() + timeout + 1)
+	if n := len(tunnel.UDPClients()); n != 0 {
+		t.Errorf("udp clients:%d after gc", n)
+	}
+	if n := app_client_sets(tunnel); n != 0 {
+		t.Errorf("app client sets:%d after gc", n)
+	}
+}
+
+func TestRemoveAppClient(t *testing.T) {
+	tunnel := NewTunnel()
+	addr := &net.UDPAddr{IP:net.IPv4(10, 0, 0, 1), Port:40000}
+	client := NewTunnelClient(addr)
+	client.appid, client.uid = 7, 1
+	tunnel.AddTunnelClient(client)
+	tunnel.RemoveAppClient(7, 1)
+	if tunnel.FindClient(addr) != nil || app_client_sets(tunnel) != 0 {
+		t.Error("client not removed")
+	}
+	check_tunnel_clients(t, tunnel)
+}
@@ -0,0 +1,253 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "io"
+import "net"
+import "fmt"
+import "sync"
+import "time"
+import "errors"
+import "strconv"
+import "testing"
+import "math/rand"
+import "sync/atomic"
+import "encoding/binary"
+
+//同时执行认证, 转发, ping和GC, 使用go test -race检查数据竞争
+const RACE_TEST_DURATION = 2*time.Second
+const RACE_TEST_USERS = 16
+
+var ErrRaceTestToken = errors.New("invalid token")
+
+//token为"t"+uid, 不访问redis
+func race_test_token(token string) (int64, int64, string, error) {
+	uid, err := strconv.ParseInt(token[1:], 10, 64)
+	if err != nil {
+		return 0, 0, "", ErrRaceTestToken
+	}
+	return 7, uid, "", nil
+}
+
+func race_test_auth(uid int64) []byte {
+	token := fmt.Sprintf("t%d", uid)
+	b := make([]byte, 3+len(token))
+	b[0] = VOIP_AUTH
+	binary.BigEndian.PutUint16(b[1:], uint16(len(token)))
+	copy(b[3:], token)
+	return b
+}
+
+func race_test_ping() []byte {
+	b := make([]byte, 9)
+	b[0] = VOIP_PING
+	return b
+}
+
+func race_test_packet(r *rand.Rand) []byte {
+	uid := int64(1 + r.Intn(RACE_TEST_USERS))
+	switch r.Intn(3) {
+	case 0:
+		return race_test_auth(uid)
+	case 1:
+		return voip_data_packet(uid, int64(1 + r.Intn(RACE_TEST_USERS)), 32)
+	default:
+		return race_test_ping()
+	}
+}
+
+func write_frame(conn net.Conn, b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := conn.Write(frame)
+	return err
+}
+
+//udp客户端在少量地址上不断切换token, 和转发, GC同时进行
+func race_test_udp(tunnel *Tunnel, stop chan struct{}, packets *int64) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var w discard_writer
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		addr := &net.UDPAddr{IP:net.IPv4(10, 0, 0, byte(r.Intn(8))), Port:40000 + r.Intn(4)}
+		tunnel.HandleData(race_test_packet(r), addr, w)
+		atomic.AddInt64(packets, 1)
+	}
+}
+
+//每个连接发送少量的包后断开, 覆盖认证过程中断开和更换token
+func race_test_stream(tunnel *Tunnel, stop chan struct{}, packets *int64) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		c1, c2 := net.Pipe()
+		go io.Copy(io.Discard, c2)
+		stream := NewTunnelStream(tunnel, c1)
+		done := make(chan struct{})
+		go func() {
+			stream.Run()
+			close(done)
+		}()
+		for i := 0; i < 1 + r.Intn(16); i++ {
+			if write_frame(c2, race_test_packet(r)) != nil {
+				break
+			}
+			atomic.AddInt64(packets, 1)
+		}
+		c2.Close()
+		<-done
+	}
+}
+
+//按照超时之后的时间清理, 每一轮都会删除客户端
+func race_test_gc(tunnel *Tunnel, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		timeout := int64(GetConfig().voip_client_timeout)
+		tunnel.collect(time.Now().Unix() + timeout + 1)
+		tunnel.ActiveClientCount(1)
+		for _, c := range tunnel.UDPClients() {
+			c.Timestamp()
+		}
+	}
+}
+
+//每个worker都执行到屏障时, 之前提交的认证都已经完成
+func wait_auth_pool(pool *WorkerPool, workers int) {
+	started := new(sync.WaitGroup)
+	started.Add(workers)
+	release := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		for !pool.Submit(func() {
+			started.Done()
+			<-release
+		}) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	started.Wait()
+	close(release)
+}
+
+//udp客户端在地址和用户两个索引中一一对应, app的tunnel客户端数等于用户索引中的客户端数
+func check_tunnel_clients(t *testing.T, tunnel *Tunnel) {
+	counts := make(map[int64]int)
+	for _, shard := range tunnel.user_shards {
+		shard.mutex.RLock()
+		for appid, client_set := range shard.app_clients {
+			for uid, c := range client_set {
+				counts[appid]++
+				if c.stream == nil && tunnel.find_client(c.key) != c {
+					t.Errorf("app:%d uid:%d not found by addr", appid, uid)
+				}
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	for _, c := range tunnel.UDPClients() {
+		if tunnel.FindAppClient(c.appid, c.uid) != c {
+			t.Errorf("addr:%s app:%d uid:%d not found by uid", c.addr, c.appid, c.uid)
+		}
+	}
+	tunnel.quotas.mutex.RLock()
+	defer tunnel.quotas.mutex.RUnlock()
+	for appid, usage := range tunnel.quotas.apps {
+		usage.mutex.Lock()
+		n := usage.tunnel_clients
+		usage.mutex.Unlock()
+		if n != counts[appid] {
+			t.Errorf("app:%d tunnel_clients:%d clients:%d", appid, n, counts[appid])
+		}
+	}
+}
+
+//同一个地址上两个token的认证同时进行, 后完成的替换先完成的
+func TestAuthReplaceAddr(t *testing.T) {
+	tunnel := NewTunnel()
+	tunnel.load_token = race_test_token
+	//没有worker协程, 两个认证都提交之后再执行
+	tunnel.auth_pool = NewWorkerPool("tunnel_auth_test", 0, 16)
+	var w discard_writer
+	addr := &net.UDPAddr{IP:net.IPv4(10, 0, 0, 1), Port:40000}
+	tunnel.HandleData(race_test_auth(1), addr, w)
+	tunnel.HandleData(race_test_auth(2), addr, w)
+	for len(tunnel.auth_pool.tasks) > 0 {
+		(<-tunnel.auth_pool.tasks)()
+	}
+
+	c := tunnel.FindClient(addr)
+	if c == nil || c.uid != 2 {
+		t.Fatal("addr not owned by the last auth")
+	}
+	if tunnel.FindAppClient(7, 1) != nil {
+		t.Error("replaced uid still routable")
+	}
+	if tunnel.FindAppClient(7, 2) != c {
+		t.Error("uid not found")
+	}
+	check_tunnel_clients(t, tunnel)
+}
+
+func TestTunnelRace(t *testing.T) {
+	tunnel := NewTunnel()
+	tunnel.load_token = race_test_token
+	tunnel.auth_pool = NewWorkerPool("tunnel_auth_test", 4, 1024)
+
+	duration := RACE_TEST_DURATION
+	if testing.Short() {
+		duration = 200*time.Millisecond
+	}
+
+	var packets int64
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		run(func() { race_test_udp(tunnel, stop, &packets) })
+		run(func() { race_test_stream(tunnel, stop, &packets) })
+	}
+	run(func() { race_test_gc(tunnel, stop) })
+
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+	wait_auth_pool(tunnel.auth_pool, 4)
+	check_tunnel_clients(t, tunnel)
+	t.Logf("packets:%d clients:%d", atomic.LoadInt64(&packets), len(tunnel.UDPClients()))
+}
@@ -0,0 +1,275 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "io"
+import "net"
+import "fmt"
+import "time"
+import "sync"
+import "crypto/tls"
+import "encoding/binary"
+import log "github.com/golang/glog"
+
+//udp被屏蔽时通过tcp(或者tls)中转媒体数据
+//每个包前加2字节的长度, 包的内容和udp tunnel相同: [header(1)][body]
+type TunnelStream struct {
+	tunnel *Tunnel
+	conn   net.Conn
+	//对端地址, 用于认证限流和VOIP_PONG
+	addr   *net.UDPAddr
+	//已经加上长度的帧, 写完之后放回frame_pool
+	wt     chan *[]byte
+	closed chan struct{}
+	//读协程和认证的worker协程都会修改, 关闭连接时也需要持有
+	mutex  sync.Mutex
+	client *TunnelClient
+	//认证成功之前读超时不随收到的包延长, 认证成功之后更换token时重新计算
+	auth_deadline time.Time
+}
+
+func NewTunnelStream(tunnel *Tunnel, conn net.Conn) *TunnelStream {
+	stream := new(TunnelStream)
+	stream.tunnel = tunnel
+	stream.conn = conn
+	stream.wt = make(chan *[]byte, GetConfig().tunnel_stream_queue_size)
+	stream.closed = make(chan struct{})
+	stream.auth_deadline = stream.new_auth_deadline()
+	if taddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		stream.addr = &net.UDPAddr{IP:taddr.IP, Port:taddr.Port, Zone:taddr.Zone}
+	} else {
+		stream.addr = &net.UDPAddr{}
+	}
+	return stream
+}
+
+//所有stream共用, 避免每个包分配一次
+var frame_pool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+//不阻塞转发的udp读协程, 队列满时丢弃
+//data是调用者的读缓冲区, 需要复制
+func (stream *TunnelStream) Write(data []byte) {
+	p := frame_pool.Get().(*[]byte)
+	frame := append((*p)[:0], 0, 0)
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	frame = append(frame, data...)
+	*p = frame
+	select {
+	case stream.wt <- p:
+	default:
+		frame_pool.Put(p)
+		tunnel_stream_stats.Add("dropped", 1)
+	}
+}
+
+func (stream *TunnelStream) write_loop() {
+	defer stream.conn.Close()
+	for {
+		select {
+		case p := <-stream.wt:
+			stream.conn.SetWriteDeadline(time.Now().Add(10*time.Second))
+			_, err := stream.conn.Write(*p)
+			frame_pool.Put(p)
+			if err != nil {
+				return
+			}
+		case <-stream.closed:
+			return
+		}
+	}
+}
+
+func (stream *TunnelStream) IsClosed() bool {
+	select {
+	case <-stream.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+//读协程返回错误后退出并清理
+func (stream *TunnelStream) Close() {
+	stream.conn.Close()
+}
+
+func (stream *TunnelStream) Client() *TunnelClient {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.client
+}
+
+//认证成功的客户端, 认证中的客户端appid为0
+func (stream *TunnelStream) AuthenticatedClient() *TunnelClient {
+	if client := stream.Client(); client != nil && client.appid != 0 {
+		return client
+	}
+	return nil
+}
+
+func (stream *TunnelStream) new_auth_deadline() time.Time {
+	return time.Now().Add(time.Duration(GetConfig().tunnel_stream_auth_timeout) * time.Second)
+}
+
+//认证成功之后每个包都延长读超时, 之前使用固定的认证期限
+func (stream *TunnelStream) read_deadline() time.Time {
+	stream.mutex.Lock()
+	client := stream.client
+	deadline := stream.auth_deadline
+	stream.mutex.Unlock()
+	if client == nil || client.appid == 0 {
+		return deadline
+	}
+	timeout := GetConfig().GetAppConfig(client.appid).voip_client_timeout
+	return time.Now().Add(time.Duration(timeout) * time.Second)
+}
+
+func (stream *TunnelStream) Run() {
+	tunnel_stream_stats.Add("accepted", 1)
+	go stream.write_loop()
+
+	header := make([]byte, 2)
+	buff := make([]byte, 64*1024)
+	for {
+		stream.conn.SetReadDeadline(stream.read_deadline())
+		if _, err := io.ReadFull(stream.conn, header); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(stream.conn, buff[:n]); err != nil {
+			break
+		}
+		stream.tunnel.HandleStreamData(stream, buff[:n])
+	}
+
+	//关闭之后worker协程不会再加入认证成功的客户端
+	stream.mutex.Lock()
+	//通知写协程退出
+	close(stream.closed)
+	client := stream.client
+	stream.mutex.Unlock()
+	if client != nil {
+		stream.tunnel.EvictClient(client, EVICT_CLOSED)
+	}
+	stream.conn.Close()
+	tunnel_stream_stats.Add("closed", 1)
+}
+
+func (tunnel *Tunnel) HandleStreamData(stream *TunnelStream, buff []byte) {
+	if len(buff) == 0 {
+		return
+	}
+	h := buff[0]
+	cmd := h&0x0f
+	if cmd == VOIP_AUTH {
+		tunnel.HandleStreamAuth(stream, buff[1:])
+	} else if cmd == VOIP_DATA {
+		if client := stream.Client(); client != nil {
+			tunnel.ForwardVOIPData(client, buff, true, nil)
+		}
+	} else if cmd == VOIP_PING {
+		//和udp相同, 只回复已经认证的客户端
+		client := stream.AuthenticatedClient()
+		if len(buff) < 9 || client == nil {
+			return
+		}
+		client.Touch(time.Now().Unix())
+		stream.Write(tunnel.PongData(buff[1:], stream.addr))
+	}
+}
+
+func (tunnel *Tunnel) HandleStreamAuth(stream *TunnelStream, buff []byte) {
+	token, err := tunnel.ReadVOIPAuth(buff)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	stream.mutex.Lock()
+	client := stream.client
+	if client != nil && client.token == token && client.appid != 0 {
+		stream.mutex.Unlock()
+		tunnel.SendAuthStatus(AUTH_STATUS_SUCCESS, client, nil)
+		client.Touch(now)
+		return
+	}
+	pending := NewTunnelClient(stream.addr)
+	pending.timestamp = now
+	pending.has_header = true
+	pending.token = token
+	pending.stream = stream
+	if client != nil && client.appid != 0 {
+		//已经认证的连接更换token, 重新等待认证, 认证中重复发送不延长期限
+		stream.auth_deadline = stream.new_auth_deadline()
+	}
+	stream.client = pending
+	stream.mutex.Unlock()
+
+	if client != nil {
+		tunnel.EvictClient(client, EVICT_REPLACED)
+	}
+	tunnel.AuthClient(pending, token, nil)
+}
+
+//在worker协程中调用, 认证过程中连接关闭或者收到了新的token时丢弃
+//只有超过app的tunnel客户端数时返回false
+func (tunnel *Tunnel) AddStreamClient(pending *TunnelClient, client *TunnelClient) bool {
+	stream := pending.stream
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.client != pending || stream.IsClosed() {
+		return true
+	}
+	if !tunnel.AddTunnelClient(client) {
+		return false
+	}
+	stream.client = client
+	return true
+}
+
+func (tunnel *Tunnel) ListenStream(port int, tls_config *tls.Config) {
+	addr := fmt.Sprintf("0.0.0.0:%d", port)
+	listen, err := ListenTCP(addr)
+	if err != nil {
+		log.Fatal("listen tcp err:", err)
+	}
+	AddListener(addr, listen)
+
+	var l net.Listener = listen
+	if tls_config != nil {
+		l = tls.NewListener(listen, tls_config)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if IsDraining() {
+			conn.Close()
+			continue
+		}
+		stream := NewTunnelStream(tunnel, conn)
+		go stream.Run()
+	}
+}
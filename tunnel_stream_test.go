@@ -0,0 +1,68 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "io"
+import "net"
+import "time"
+import "testing"
+
+//没有认证的连接发送ping不会收到回复, 也不能延长连接
+func TestStreamAuthTimeout(t *testing.T) {
+	old := GetConfig()
+	cfg := *old
+	cfg.tunnel_stream_auth_timeout = 1
+	SetConfig(&cfg)
+	defer SetConfig(old)
+
+	tunnel := NewTunnel()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	stream := NewTunnelStream(tunnel, c1)
+	done := make(chan struct{})
+	go func() {
+		stream.Run()
+		close(done)
+	}()
+	replies := make(chan int, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, c2)
+		replies <- int(n)
+	}()
+
+	start := time.Now()
+	for time.Since(start) < 2*time.Second {
+		if write_frame(c2, race_test_ping()) != nil {
+			break
+		}
+		time.Sleep(100*time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("unauthenticated stream not closed")
+	}
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("stream closed after %s", d)
+	}
+	if n := <-replies; n != 0 {
+		t.Errorf("unauthenticated stream got %d bytes", n)
+	}
+}
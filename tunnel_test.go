@@ -0,0 +1,132 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "os"
+import "net"
+import "testing"
+import "net/netip"
+import "encoding/binary"
+
+func TestMain(m *testing.M) {
+	//不读取配置文件, 使用默认配置, 不限制认证频率
+	cfg, _ := load_cfg("")
+	cfg.tunnel_auth_rate = 0
+	SetConfig(cfg)
+	os.Exit(m.Run())
+}
+
+//race detector下sync.Pool会随机丢弃对象, 不检查内存分配
+var race_enabled = false
+
+type discard_writer struct{}
+
+func (w discard_writer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func voip_data_packet(sender, receiver int64, size int) []byte {
+	pkt := make([]byte, 17+size)
+	pkt[0] = VOIP_DATA
+	binary.BigEndian.PutUint64(pkt[1:], uint64(sender))
+	binary.BigEndian.PutUint64(pkt[9:], uint64(receiver))
+	return pkt
+}
+
+func add_test_client(t *Tunnel, ap netip.AddrPort, appid int64, uid int64) *TunnelClient {
+	client := NewTunnelClient(net.UDPAddrFromAddrPort(ap))
+	client.appid, client.uid, client.has_header = appid, uid, true
+	t.AddTunnelClient(client)
+	return client
+}
+
+func TestForwardAllocs(t *testing.T) {
+	if race_enabled {
+		t.Skip("race detector enabled")
+	}
+	tunnel := NewTunnel()
+	ap1 := netip.MustParseAddrPort("10.0.0.1:40001")
+	ap2 := netip.MustParseAddrPort("[2001:db8::2]:40002")
+	add_test_client(tunnel, ap1, 7, 100)
+	add_test_client(tunnel, ap2, 7, 200)
+
+	var w discard_writer
+	pkt := voip_data_packet(100, 200, 160)
+	stream := &TunnelStream{wt:make(chan *[]byte, 1)}
+
+	cases := []struct {
+		name string
+		f    func()
+	}{
+		{"read_voip_data", func() { tunnel.ReadVOIPData(pkt[1:]) }},
+		{"forward_udp", func() { tunnel.HandlePacket(pkt, ap1, w) }},
+		{"forward_stream", func() {
+			stream.Write(pkt)
+			frame_pool.Put(<-stream.wt)
+		}},
+	}
+	for _, c := range cases {
+		if n := testing.AllocsPerRun(1000, c.f); n > 0 {
+			t.Errorf("%s allocs:%v", c.name, n)
+		}
+	}
+}
+
+//配置了配额时, 通话开始之后的包只更新原子计数
+func TestForwardQuotaAllocs(t *testing.T) {
+	if race_enabled {
+		t.Skip("race detector enabled")
+	}
+	old := GetConfig()
+	cfg := *old
+	cfg.app_max_calls = 10
+	cfg.app_max_bandwidth = 1 << 40
+	cfg.forward_quota = cfg.has_forward_quota()
+	SetConfig(&cfg)
+	defer SetConfig(old)
+
+	tunnel := NewTunnel()
+	ap1 := netip.MustParseAddrPort("10.0.0.1:40001")
+	add_test_client(tunnel, ap1, 7, 100)
+	add_test_client(tunnel, netip.MustParseAddrPort("10.0.0.2:40002"), 7, 200)
+
+	var w discard_writer
+	pkt := voip_data_packet(100, 200, 160)
+	if n := testing.AllocsPerRun(1000, func() { tunnel.HandlePacket(pkt, ap1, w) }); n > 0 {
+		t.Errorf("forward with quota allocs:%v", n)
+	}
+	if calls := tunnel.quotas.Get(7).Calls(); calls != 1 {
+		t.Errorf("calls:%d", calls)
+	}
+}
+
+func BenchmarkForwardUDP(b *testing.B) {
+	tunnel := NewTunnel()
+	ap1 := netip.MustParseAddrPort("10.0.0.1:40001")
+	add_test_client(tunnel, ap1, 7, 100)
+	add_test_client(tunnel, netip.MustParseAddrPort("10.0.0.2:40002"), 7, 200)
+
+	var w discard_writer
+	pkt := voip_data_packet(100, 200, 160)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tunnel.HandlePacket(pkt, ap1, w)
+	}
+}
@@ -0,0 +1,697 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "fmt"
+import "sync"
+import "time"
+import "strconv"
+import "strings"
+import "crypto/md5"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha1"
+import "encoding/hex"
+import "encoding/binary"
+import log "github.com/golang/glog"
+
+//RFC 5766 TURN, 使用长期凭证, username和password都是access token
+const TURN_METHOD_ALLOCATE = 0x003
+const TURN_METHOD_REFRESH = 0x004
+const TURN_METHOD_SEND = 0x006
+const TURN_METHOD_DATA = 0x007
+const TURN_METHOD_CREATE_PERMISSION = 0x008
+const TURN_METHOD_CHANNEL_BIND = 0x009
+
+const STUN_CLASS_REQUEST = 0x0000
+const STUN_CLASS_INDICATION = 0x0010
+const STUN_CLASS_SUCCESS = 0x0100
+const STUN_CLASS_ERROR = 0x0110
+
+const TURN_ATTR_CHANNEL_NUMBER = 0x000C
+const TURN_ATTR_LIFETIME = 0x000D
+const TURN_ATTR_XOR_PEER_ADDRESS = 0x0012
+const TURN_ATTR_DATA = 0x0013
+const TURN_ATTR_XOR_RELAYED_ADDRESS = 0x0016
+const TURN_ATTR_REQUESTED_TRANSPORT = 0x0019
+
+const TURN_TRANSPORT_UDP = 17
+
+const TURN_DEFAULT_LIFETIME = 10*60
+const TURN_MAX_LIFETIME = 60*60
+const TURN_PERMISSION_LIFETIME = 5*60
+const TURN_CHANNEL_LIFETIME = 10*60
+const TURN_NONCE_LIFETIME = 10*60
+
+const TURN_CHANNEL_MIN = 0x4000
+const TURN_CHANNEL_MAX = 0x7FFF
+
+var turn_known_attributes = map[uint16]bool{
+	STUN_ATTR_USERNAME:            true,
+	STUN_ATTR_MESSAGE_INTEGRITY:   true,
+	STUN_ATTR_REALM:               true,
+	STUN_ATTR_NONCE:               true,
+	TURN_ATTR_CHANNEL_NUMBER:      true,
+	TURN_ATTR_LIFETIME:            true,
+	TURN_ATTR_XOR_PEER_ADDRESS:    true,
+	TURN_ATTR_DATA:                true,
+	TURN_ATTR_REQUESTED_TRANSPORT: true,
+}
+
+type TURNAllocation struct {
+	mutex    sync.Mutex
+	client   *net.UDPAddr
+	relay    *net.UDPConn
+	appid    int64
+	uid      int64
+	username string
+	key      []byte
+	expire   time.Time
+	//分配成功后设置, 计入app的分配数和带宽
+	usage    *AppUsage
+	//peer ip -> 过期时间
+	permissions    map[string]time.Time
+	channels       map[uint16]*net.UDPAddr
+	peer_channels  map[string]uint16
+	channel_expire map[uint16]time.Time
+}
+
+type TURNServer struct {
+	mutex        sync.Mutex
+	conn         *net.UDPConn
+	realm        string
+	relay_ip     net.IP
+	//客户端地址 -> allocation
+	allocations  map[string]*TURNAllocation
+	nonce_secret []byte
+	quotas       *AppQuotas
+}
+
+var turn_server *TURNServer
+
+func NewTURNServer(realm string, relay_ip net.IP, quotas *AppQuotas) *TURNServer {
+	server := new(TURNServer)
+	server.realm = realm
+	server.relay_ip = relay_ip
+	server.quotas = quotas
+	server.allocations = make(map[string]*TURNAllocation)
+	server.nonce_secret = make([]byte, 16)
+	rand.Read(server.nonce_secret)
+	return server
+}
+
+func turn_method(msg_type uint16) uint16 {
+	return msg_type & 0x3EEF
+}
+
+func turn_class(msg_type uint16) uint16 {
+	return msg_type & 0x0110
+}
+
+func turn_long_term_key(username string, realm string, password string) []byte {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+//时间戳 + hmac, 不需要保存状态
+func (server *TURNServer) NewNonce() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 16)
+	mac := hmac.New(sha1.New, server.nonce_secret)
+	mac.Write([]byte(ts))
+	return ts + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (server *TURNServer) IsNonceValid(nonce string) bool {
+	if len(nonce) <= 16 {
+		return false
+	}
+	ts := nonce[:len(nonce)-16]
+	mac := hmac.New(sha1.New, server.nonce_secret)
+	mac.Write([]byte(ts))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))[:16]), []byte(nonce[len(nonce)-16:])) {
+		return false
+	}
+	t, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix()-t < TURN_NONCE_LIFETIME
+}
+
+func parse_xor_address(v []byte, transaction_id []byte) *net.UDPAddr {
+	if len(v) != 8 && len(v) != 20 {
+		return nil
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], STUN_MAGIC_COOKIE)
+	copy(key[4:], transaction_id)
+
+	port := int(binary.BigEndian.Uint16(v[2:4]) ^ uint16(STUN_MAGIC_COOKIE>>16))
+	ip := make(net.IP, len(v)-4)
+	for i := range ip {
+		ip[i] = v[4+i] ^ key[i]
+	}
+	if (v[1] == 0x01 && len(ip) != 4) || (v[1] == 0x02 && len(ip) != 16) {
+		return nil
+	}
+	return &net.UDPAddr{IP:ip, Port:port}
+}
+
+func (server *TURNServer) SendError(msg_type uint16, transaction_id []byte, code int, reason string,
+	addr *net.UDPAddr, key []byte) {
+	m := NewSTUNMessage(turn_method(msg_type)|STUN_CLASS_ERROR, transaction_id)
+	m.AddErrorCode(code, reason)
+	if code == 401 || code == 438 {
+		m.AddAttribute(STUN_ATTR_REALM, []byte(server.realm))
+		m.AddAttribute(STUN_ATTR_NONCE, []byte(server.NewNonce()))
+	}
+	turn_stats.Add(fmt.Sprintf("error_%d", code), 1)
+	if key != nil {
+		server.conn.WriteTo(m.ToDataWithIntegrity(key), addr)
+	} else {
+		server.conn.WriteTo(m.ToData(), addr)
+	}
+}
+
+func (server *TURNServer) FindAllocation(addr *net.UDPAddr) *TURNAllocation {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.allocations[addr.String()]
+}
+
+func (server *TURNServer) RemoveAllocation(alloc *TURNAllocation) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	key := alloc.client.String()
+	if a, ok := server.allocations[key]; ok && a == alloc {
+		delete(server.allocations, key)
+		alloc.relay.Close()
+		alloc.usage.RemoveTURNAllocation()
+		log.Infof("turn allocation removed appid:%d uid:%d client:%s", alloc.appid, alloc.uid, key)
+	}
+}
+
+func (server *TURNServer) HandleChannelData(buff []byte, addr *net.UDPAddr) {
+	if len(buff) < 4 {
+		return
+	}
+	channel := binary.BigEndian.Uint16(buff[0:2])
+	length := int(binary.BigEndian.Uint16(buff[2:4]))
+	if 4+length > len(buff) {
+		return
+	}
+	alloc := server.FindAllocation(addr)
+	if alloc == nil {
+		return
+	}
+	alloc.mutex.Lock()
+	peer, ok := alloc.channels[channel]
+	alloc.mutex.Unlock()
+	if !ok || !alloc.AddBytes(length) {
+		return
+	}
+	alloc.relay.WriteTo(buff[4:4+length], peer)
+}
+
+func (server *TURNServer) HandleSendIndication(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr) {
+	alloc := server.FindAllocation(addr)
+	if alloc == nil {
+		return
+	}
+	peer_attr := FindSTUNAttribute(attrs, TURN_ATTR_XOR_PEER_ADDRESS)
+	data_attr := FindSTUNAttribute(attrs, TURN_ATTR_DATA)
+	if peer_attr == nil || data_attr == nil {
+		return
+	}
+	peer := parse_xor_address(peer_attr.value, buff[8:20])
+	if peer == nil || !alloc.HasPermission(peer.IP) {
+		return
+	}
+	if !alloc.AddBytes(len(data_attr.value)) {
+		return
+	}
+	alloc.relay.WriteTo(data_attr.value, peer)
+}
+
+//中转的数据计入app的带宽, 和tunnel共用配额, 超过时丢弃
+func (alloc *TURNAllocation) AddBytes(n int) bool {
+	_, _, max_bandwidth := GetConfig().AppQuota(alloc.appid)
+	if max_bandwidth <= 0 {
+		return true
+	}
+	return alloc.usage.AddBytes(n, time.Now().Unix(), max_bandwidth)
+}
+
+func (alloc *TURNAllocation) HasPermission(ip net.IP) bool {
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+	expire, ok := alloc.permissions[ip.String()]
+	return ok && time.Now().Before(expire)
+}
+
+func (server *TURNServer) HandleData(buff []byte, addr *net.UDPAddr) {
+	if len(buff) == 0 {
+		return
+	}
+	//ChannelData的前两位是01
+	if buff[0]&0xC0 == 0x40 {
+		server.HandleChannelData(buff, addr)
+		return
+	}
+	if !IsSTUNMessage(buff) {
+		return
+	}
+
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	if msg_type == STUN_BINDING_REQUEST {
+		HandleSTUNBinding(buff, addr, server.conn)
+		return
+	}
+	attrs := ParseSTUNAttributes(buff)
+	method := turn_method(msg_type)
+	class := turn_class(msg_type)
+	if class == STUN_CLASS_INDICATION {
+		if method == TURN_METHOD_SEND {
+			server.HandleSendIndication(buff, attrs, addr)
+		}
+		return
+	}
+	if class != STUN_CLASS_REQUEST {
+		return
+	}
+
+	transaction_id := buff[8:20]
+	if unknown := stun_unknown_attributes(attrs, turn_known_attributes); len(unknown) > 0 {
+		m := stun_unknown_attributes_error(method|STUN_CLASS_ERROR, transaction_id, unknown)
+		server.conn.WriteTo(m.ToData(), addr)
+		return
+	}
+
+	integrity := FindSTUNAttribute(attrs, STUN_ATTR_MESSAGE_INTEGRITY)
+	if integrity == nil {
+		server.SendError(msg_type, transaction_id, 401, "Unauthorized", addr, nil)
+		return
+	}
+	username := FindSTUNAttribute(attrs, STUN_ATTR_USERNAME)
+	realm := FindSTUNAttribute(attrs, STUN_ATTR_REALM)
+	nonce := FindSTUNAttribute(attrs, STUN_ATTR_NONCE)
+	if username == nil || realm == nil || nonce == nil {
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, nil)
+		return
+	}
+	if !server.IsNonceValid(string(nonce.value)) {
+		server.SendError(msg_type, transaction_id, 438, "Stale Nonce", addr, nil)
+		return
+	}
+
+	alloc := server.FindAllocation(addr)
+	if alloc != nil {
+		//已经有allocation, 不需要再访问redis
+		if alloc.username != string(username.value) {
+			server.SendError(msg_type, transaction_id, 441, "Wrong Credentials", addr, nil)
+			return
+		}
+		if !VerifySTUNIntegrity(buff, integrity, alloc.key) {
+			server.SendError(msg_type, transaction_id, 401, "Unauthorized", addr, nil)
+			return
+		}
+		server.HandleRequest(buff, attrs, addr, alloc, nil)
+		return
+	}
+
+	if method != TURN_METHOD_ALLOCATE {
+		server.SendError(msg_type, transaction_id, 437, "Allocation Mismatch", addr, nil)
+		return
+	}
+
+	//认证需要访问redis, 不阻塞读协程
+	data := append([]byte(nil), buff...)
+	token := string(username.value)
+	r := tunnel_auth_pool.Submit(func() {
+		attrs := ParseSTUNAttributes(data)
+		integrity := FindSTUNAttribute(attrs, STUN_ATTR_MESSAGE_INTEGRITY)
+		transaction_id := data[8:20]
+		appid, uid, _, err := LoadUserAccessTokenCached(token)
+		if err == ErrRedisUnavailable {
+			server.SendError(msg_type, transaction_id, 508, "Insufficient Capacity", addr, nil)
+			return
+		} else if err != nil || appid == 0 || uid == 0 {
+			server.SendError(msg_type, transaction_id, 401, "Unauthorized", addr, nil)
+			return
+		}
+		key := turn_long_term_key(token, server.realm, token)
+		if !VerifySTUNIntegrity(data, integrity, key) {
+			server.SendError(msg_type, transaction_id, 401, "Unauthorized", addr, nil)
+			return
+		}
+		user := &TURNAllocation{appid:appid, uid:uid, username:token, key:key}
+		server.HandleRequest(data, attrs, addr, nil, user)
+	})
+	if !r {
+		server.SendError(msg_type, transaction_id, 508, "Insufficient Capacity", addr, nil)
+	}
+}
+
+//user只在allocate时不为空, 包含认证后的用户信息
+func (server *TURNServer) HandleRequest(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr,
+	alloc *TURNAllocation, user *TURNAllocation) {
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	switch turn_method(msg_type) {
+	case TURN_METHOD_ALLOCATE:
+		if alloc != nil {
+			server.SendError(msg_type, buff[8:20], 437, "Allocation Mismatch", addr, alloc.key)
+			return
+		}
+		server.HandleAllocate(buff, attrs, addr, user)
+	case TURN_METHOD_REFRESH:
+		server.HandleRefresh(buff, attrs, addr, alloc)
+	case TURN_METHOD_CREATE_PERMISSION:
+		server.HandleCreatePermission(buff, attrs, addr, alloc)
+	case TURN_METHOD_CHANNEL_BIND:
+		server.HandleChannelBind(buff, attrs, addr, alloc)
+	default:
+		server.SendError(msg_type, buff[8:20], 400, "Bad Request", addr, alloc.key)
+	}
+}
+
+func turn_lifetime(attrs []*STUNAttribute) int {
+	attr := FindSTUNAttribute(attrs, TURN_ATTR_LIFETIME)
+	if attr == nil || len(attr.value) != 4 {
+		return TURN_DEFAULT_LIFETIME
+	}
+	lifetime := int(binary.BigEndian.Uint32(attr.value))
+	if lifetime > TURN_MAX_LIFETIME {
+		lifetime = TURN_MAX_LIFETIME
+	}
+	return lifetime
+}
+
+func lifetime_value(lifetime int) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(lifetime))
+	return v
+}
+
+func (server *TURNServer) HandleAllocate(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr,
+	user *TURNAllocation) {
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	transaction_id := buff[8:20]
+
+	transport := FindSTUNAttribute(attrs, TURN_ATTR_REQUESTED_TRANSPORT)
+	if transport == nil || len(transport.value) != 4 {
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, user.key)
+		return
+	}
+	if transport.value[0] != TURN_TRANSPORT_UDP {
+		server.SendError(msg_type, transaction_id, 442, "Unsupported Transport Protocol", addr, user.key)
+		return
+	}
+
+	cfg := GetConfig()
+	server.mutex.Lock()
+	count := len(server.allocations)
+	server.mutex.Unlock()
+	if cfg.turn_max_allocations > 0 && count >= cfg.turn_max_allocations {
+		server.SendError(msg_type, transaction_id, 486, "Allocation Quota Reached", addr, user.key)
+		return
+	}
+	usage := server.quotas.Get(user.appid)
+	if !usage.AddTURNAllocation(cfg.AppTURNQuota(user.appid)) {
+		server.SendError(msg_type, transaction_id, 486, "Allocation Quota Reached", addr, user.key)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		usage.RemoveTURNAllocation()
+		log.Warning("turn listen relay err:", err)
+		server.SendError(msg_type, transaction_id, 508, "Insufficient Capacity", addr, user.key)
+		return
+	}
+
+	lifetime := turn_lifetime(attrs)
+	if lifetime == 0 {
+		lifetime = TURN_DEFAULT_LIFETIME
+	}
+	alloc := user
+	alloc.client = addr
+	alloc.relay = relay
+	alloc.usage = usage
+	alloc.expire = time.Now().Add(time.Duration(lifetime) * time.Second)
+	alloc.permissions = make(map[string]time.Time)
+	alloc.channels = make(map[uint16]*net.UDPAddr)
+	alloc.peer_channels = make(map[string]uint16)
+	alloc.channel_expire = make(map[uint16]time.Time)
+
+	server.mutex.Lock()
+	if _, ok := server.allocations[addr.String()]; ok {
+		//重传的allocate请求
+		server.mutex.Unlock()
+		relay.Close()
+		usage.RemoveTURNAllocation()
+		server.SendError(msg_type, transaction_id, 437, "Allocation Mismatch", addr, user.key)
+		return
+	}
+	server.allocations[addr.String()] = alloc
+	server.mutex.Unlock()
+
+	go server.RunRelay(alloc)
+
+	relay_addr := &net.UDPAddr{IP:server.relay_ip, Port:relay.LocalAddr().(*net.UDPAddr).Port}
+	log.Infof("turn allocation appid:%d uid:%d client:%s relay:%s", alloc.appid, alloc.uid, addr, relay_addr)
+	turn_stats.Add("allocations", 1)
+
+	m := NewSTUNMessage(TURN_METHOD_ALLOCATE|STUN_CLASS_SUCCESS, transaction_id)
+	m.AddAttribute(TURN_ATTR_XOR_RELAYED_ADDRESS, stun_xor_mapped_address(relay_addr, transaction_id))
+	m.AddAttribute(TURN_ATTR_LIFETIME, lifetime_value(lifetime))
+	m.AddAttribute(STUN_ATTR_XOR_MAPPED_ADDRESS, stun_xor_mapped_address(addr, transaction_id))
+	server.conn.WriteTo(m.ToDataWithIntegrity(alloc.key), addr)
+}
+
+func (server *TURNServer) HandleRefresh(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr,
+	alloc *TURNAllocation) {
+	transaction_id := buff[8:20]
+	lifetime := turn_lifetime(attrs)
+	if lifetime == 0 {
+		server.RemoveAllocation(alloc)
+	} else {
+		alloc.mutex.Lock()
+		alloc.expire = time.Now().Add(time.Duration(lifetime) * time.Second)
+		alloc.mutex.Unlock()
+	}
+	m := NewSTUNMessage(TURN_METHOD_REFRESH|STUN_CLASS_SUCCESS, transaction_id)
+	m.AddAttribute(TURN_ATTR_LIFETIME, lifetime_value(lifetime))
+	server.conn.WriteTo(m.ToDataWithIntegrity(alloc.key), addr)
+}
+
+//默认不允许内网和本机地址作为peer, 否则持有token就可以通过中转访问服务器所在的内网
+func turn_peer_allowed(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return false
+	}
+	return GetConfig().turn_allow_private_peers != 0 || !is_private_ip(ip)
+}
+
+func (server *TURNServer) HandleCreatePermission(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr,
+	alloc *TURNAllocation) {
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	transaction_id := buff[8:20]
+
+	peers := make([]*net.UDPAddr, 0)
+	for _, attr := range attrs {
+		if attr.attr_type != TURN_ATTR_XOR_PEER_ADDRESS {
+			continue
+		}
+		peer := parse_xor_address(attr.value, transaction_id)
+		if peer == nil {
+			server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+			return
+		}
+		if !turn_peer_allowed(peer.IP) {
+			server.SendError(msg_type, transaction_id, 403, "Forbidden", addr, alloc.key)
+			return
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+		return
+	}
+
+	expire := time.Now().Add(TURN_PERMISSION_LIFETIME * time.Second)
+	alloc.mutex.Lock()
+	for _, peer := range peers {
+		alloc.permissions[peer.IP.String()] = expire
+	}
+	alloc.mutex.Unlock()
+
+	m := NewSTUNMessage(TURN_METHOD_CREATE_PERMISSION|STUN_CLASS_SUCCESS, transaction_id)
+	server.conn.WriteTo(m.ToDataWithIntegrity(alloc.key), addr)
+}
+
+func (server *TURNServer) HandleChannelBind(buff []byte, attrs []*STUNAttribute, addr *net.UDPAddr,
+	alloc *TURNAllocation) {
+	msg_type := binary.BigEndian.Uint16(buff[0:2])
+	transaction_id := buff[8:20]
+
+	channel_attr := FindSTUNAttribute(attrs, TURN_ATTR_CHANNEL_NUMBER)
+	peer_attr := FindSTUNAttribute(attrs, TURN_ATTR_XOR_PEER_ADDRESS)
+	if channel_attr == nil || peer_attr == nil || len(channel_attr.value) != 4 {
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+		return
+	}
+	channel := binary.BigEndian.Uint16(channel_attr.value)
+	peer := parse_xor_address(peer_attr.value, transaction_id)
+	if peer == nil || channel < TURN_CHANNEL_MIN || channel > TURN_CHANNEL_MAX {
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+		return
+	}
+	if !turn_peer_allowed(peer.IP) {
+		server.SendError(msg_type, transaction_id, 403, "Forbidden", addr, alloc.key)
+		return
+	}
+
+	now := time.Now()
+	alloc.mutex.Lock()
+	//通道和peer必须一一对应
+	if p, ok := alloc.channels[channel]; ok && p.String() != peer.String() {
+		alloc.mutex.Unlock()
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+		return
+	}
+	if c, ok := alloc.peer_channels[peer.String()]; ok && c != channel {
+		alloc.mutex.Unlock()
+		server.SendError(msg_type, transaction_id, 400, "Bad Request", addr, alloc.key)
+		return
+	}
+	alloc.channels[channel] = peer
+	alloc.peer_channels[peer.String()] = channel
+	alloc.channel_expire[channel] = now.Add(TURN_CHANNEL_LIFETIME * time.Second)
+	alloc.permissions[peer.IP.String()] = now.Add(TURN_PERMISSION_LIFETIME * time.Second)
+	alloc.mutex.Unlock()
+
+	m := NewSTUNMessage(TURN_METHOD_CHANNEL_BIND|STUN_CLASS_SUCCESS, transaction_id)
+	server.conn.WriteTo(m.ToDataWithIntegrity(alloc.key), addr)
+}
+
+//从peer收到的数据转发给客户端, 绑定了通道时使用ChannelData
+func (server *TURNServer) RunRelay(alloc *TURNAllocation) {
+	buff := make([]byte, 64*1024)
+	for {
+		n, peer, err := alloc.relay.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		if !alloc.HasPermission(peer.IP) || !alloc.AddBytes(n) {
+			continue
+		}
+
+		alloc.mutex.Lock()
+		channel, ok := alloc.peer_channels[peer.String()]
+		alloc.mutex.Unlock()
+
+		if ok {
+			data := make([]byte, 4+n)
+			binary.BigEndian.PutUint16(data[0:2], channel)
+			binary.BigEndian.PutUint16(data[2:4], uint16(n))
+			copy(data[4:], buff[:n])
+			server.conn.WriteTo(data, alloc.client)
+		} else {
+			transaction_id := make([]byte, 12)
+			rand.Read(transaction_id)
+			m := NewSTUNMessage(TURN_METHOD_DATA|STUN_CLASS_INDICATION, transaction_id)
+			m.AddAttribute(TURN_ATTR_XOR_PEER_ADDRESS, stun_xor_mapped_address(peer, transaction_id))
+			m.AddAttribute(TURN_ATTR_DATA, buff[:n])
+			server.conn.WriteTo(m.ToData(), alloc.client)
+		}
+	}
+}
+
+//清理过期的allocation, permission和channel
+func (server *TURNServer) GC() {
+	now := time.Now()
+	server.mutex.Lock()
+	allocs := make([]*TURNAllocation, 0, len(server.allocations))
+	for _, alloc := range server.allocations {
+		allocs = append(allocs, alloc)
+	}
+	server.mutex.Unlock()
+
+	for _, alloc := range allocs {
+		alloc.mutex.Lock()
+		expired := now.After(alloc.expire)
+		for ip, expire := range alloc.permissions {
+			if now.After(expire) {
+				delete(alloc.permissions, ip)
+			}
+		}
+		for channel, expire := range alloc.channel_expire {
+			if now.After(expire) {
+				peer := alloc.channels[channel]
+				delete(alloc.channels, channel)
+				delete(alloc.peer_channels, peer.String())
+				delete(alloc.channel_expire, channel)
+			}
+		}
+		alloc.mutex.Unlock()
+		if expired {
+			server.RemoveAllocation(alloc)
+		}
+	}
+}
+
+func (server *TURNServer) Run() {
+	addr := fmt.Sprintf(":%d", config.turn_port)
+	conn, err := ListenUDP(addr)
+	if err != nil {
+		log.Fatal("listen turn err:", err)
+	}
+	server.conn = conn
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		for range ticker.C {
+			server.GC()
+		}
+	}()
+
+	log.Infof("turn server port:%d realm:%s relay ip:%s", config.turn_port, server.realm, server.relay_ip)
+	buff := make([]byte, 64*1024)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			if reader_gate.IsPaused() {
+				reader_gate.Wait()
+				continue
+			}
+			log.Warning("read udp err:", err)
+			continue
+		}
+		if IsDraining() && server.FindAllocation(raddr) == nil {
+			continue
+		}
+		server.HandleData(buff[:n], raddr)
+	}
+}
+
+func turn_realm_valid(realm string) bool {
+	return len(realm) > 0 && !strings.ContainsAny(realm, "\\\"")
+}
@@ -0,0 +1,51 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+import "net"
+import "testing"
+
+func TestTURNPeerAllowed(t *testing.T) {
+	denied := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "100.64.0.1",
+		"169.254.169.254", "0.0.0.0", "224.0.0.1", "255.255.255.255",
+		"::1", "::", "fe80::1", "fd00::1", "::ffff:10.0.0.1"}
+	for _, s := range denied {
+		if turn_peer_allowed(net.ParseIP(s)) {
+			t.Errorf("peer %s allowed", s)
+		}
+	}
+	for _, s := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		if !turn_peer_allowed(net.ParseIP(s)) {
+			t.Errorf("peer %s denied", s)
+		}
+	}
+
+	old := GetConfig()
+	cfg := *old
+	cfg.turn_allow_private_peers = 1
+	SetConfig(&cfg)
+	defer SetConfig(old)
+	if !turn_peer_allowed(net.ParseIP("10.1.2.3")) {
+		t.Error("private peer denied with turn_allow_private_peers")
+	}
+	if turn_peer_allowed(net.ParseIP("224.0.0.1")) {
+		t.Error("multicast peer allowed")
+	}
+}
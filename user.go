@@ -27,6 +27,9 @@ import "errors"
 
 const CHARACTER_SET = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+var ErrTokenNonExists = errors.New("token non exists")
+var ErrTokenExpired = errors.New("token expired")
+
 func GenUserToken() string {
 	b := make([]byte, 30)
 	for i := 0; i < 30; i++ {
@@ -37,11 +40,8 @@ func GenUserToken() string {
 }
 
 func GetUserAccessToken(appid int64, uid int64) string {
-	conn := redis_pool.Get()
-	defer conn.Close()
-
 	key := fmt.Sprintf("users_%d_%d", appid, uid)
-	token, err := redis.String(conn.Do("HGET", key, "access_token"))
+	token, err := redis.String(redis_store.Do("HGET", key, "access_token"))
 	if err != nil {
 		log.Infof("hget %s err:%s\n", key, err)
 		return ""
@@ -50,50 +50,57 @@ func GetUserAccessToken(appid int64, uid int64) string {
 }
 
 func LoadUserAccessToken(token string) (int64, int64, string, error) {
-	conn := redis_pool.Get()
-	defer conn.Close()
+	appid, uid, uname, _, err := load_user_access_token(token)
+	return appid, uid, uname, err
+}
 
+//同时返回token的过期时间(unix时间戳), 0表示不过期
+func load_user_access_token(token string) (int64, int64, string, int64, error) {
 	key := fmt.Sprintf("access_token_%s", token)
 	var uid int64
 	var appid int64
 	var uname string
+	//可选的过期时间(unix时间戳)
+	var expires int64
 
-	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	exists, err := redis.Bool(redis_store.Do("EXISTS", key))
 	if err != nil {
-		return 0, 0, "", err
+		return 0, 0, "", 0, err
 	}
 	if !exists {
-		return 0, 0, "", errors.New("token non exists")
+		return 0, 0, "", 0, ErrTokenNonExists
 	}
 
-	reply, err := redis.Values(conn.Do("HMGET", key, "user_id", "app_id", "user_name"))
+	reply, err := redis.Values(redis_store.Do("HMGET", key, "user_id", "app_id", "user_name", "expires"))
 	if err != nil {
 		log.Info("hmget error:", err)
-		return 0, 0, "", err
+		return 0, 0, "", 0, err
 	}
 
-	_, err = redis.Scan(reply, &uid, &appid, &uname)
+	_, err = redis.Scan(reply, &uid, &appid, &uname, &expires)
 	if err != nil {
 		log.Warning("scan error:", err)
-		return 0, 0, "", err
+		return 0, 0, "", 0, err
+	}
+	if expires > 0 && expires < time.Now().Unix() {
+		return 0, 0, "", 0, ErrTokenExpired
 	}
-	return appid, uid, uname, nil	
+	return appid, uid, uname, expires, nil
 }
 
-func SaveUserAccessToken(appid int64, uid int64, uname string, token string) error {
-	conn := redis_pool.Get()
-	defer conn.Close()
-
+//expires为过期时间(unix时间戳), 0表示不过期, 过期之后认证返回AUTH_STATUS_EXPIRED
+func SaveUserAccessToken(appid int64, uid int64, uname string, token string, expires int64) error {
 	key := fmt.Sprintf("access_token_%s", token)
 	
-	_, err := conn.Do("HMSET", key, "user_id", uid, "user_name", uname, "app_id", appid)
+	_, err := redis_store.Do("HMSET", key, "user_id", uid, "user_name", uname, "app_id", appid,
+		"expires", expires)
 	if err != nil {
 		log.Info("hmset err:", err)
 		return err
 	}
 
 	key = fmt.Sprintf("users_%d_%d", appid, uid)
-	_, err = conn.Do("HSET", key, "access_token", token)
+	_, err = redis_store.Do("HSET", key, "access_token", token)
 	if err != nil {
 		log.Info("hget err:", err)
 		return err
@@ -102,13 +109,10 @@ func SaveUserAccessToken(appid int64, uid int64, uname string, token string) err
 }
 
 func SaveUserDeviceToken(appid int64, uid int64, device_token string, ng_device_token string) error {
-	conn := redis_pool.Get()
-	defer conn.Close()
-
 	now := time.Now().Unix()
 	key := fmt.Sprintf("users_%d_%d", appid, uid)
 	if len(device_token) > 0 {
-		_, err := conn.Do("HMSET", key, "apns_device_token", device_token, 
+		_, err := redis_store.Do("HMSET", key, "apns_device_token", device_token, 
 			"apns_timestamp", now)
 		if err != nil {
 			log.Info("hget err:", err)
@@ -116,7 +120,7 @@ func SaveUserDeviceToken(appid int64, uid int64, device_token string, ng_device_
 		}
 	}
 	if len(ng_device_token) > 0 {
-		_, err := conn.Do("HMSET", key, "ng_device_token", ng_device_token, 
+		_, err := redis_store.Do("HMSET", key, "ng_device_token", ng_device_token, 
 			"ng_timestamp", now)
 		if err != nil {
 			log.Info("hget err:", err)
@@ -127,12 +131,9 @@ func SaveUserDeviceToken(appid int64, uid int64, device_token string, ng_device_
 }
 
 func ResetUserDeviceToken(appid int64, uid int64, device_token string, ng_device_token string) error {
-	conn := redis_pool.Get()
-	defer conn.Close()
-
 	key := fmt.Sprintf("users_%d_%d", appid, uid)
 	if len(device_token) > 0 {
-		token, err := redis.String(conn.Do("HGET", key, "apns_device_token"))
+		token, err := redis.String(redis_store.Do("HGET", key, "apns_device_token"))
 		if err != nil {
 			log.Info("hget err:", err)
 			return err
@@ -141,7 +142,7 @@ func ResetUserDeviceToken(appid int64, uid int64, device_token string, ng_device
 			log.Infof("reset apns token:%s device token:%s\n", token, device_token)
 			return nil
 		}
-		_, err = conn.Do("HDEL", key, "apns_device_token", "apns_timestamp")
+		_, err = redis_store.Do("HDEL", key, "apns_device_token", "apns_timestamp")
 		if err != nil {
 			log.Info("hdel err:", err)
 			return err
@@ -149,7 +150,7 @@ func ResetUserDeviceToken(appid int64, uid int64, device_token string, ng_device
 	}
 
 	if len(ng_device_token) > 0 {
-		token, err := redis.String(conn.Do("HGET", key, "ng_device_token"))
+		token, err := redis.String(redis_store.Do("HGET", key, "ng_device_token"))
 		if err != nil {
 			log.Info("hget err:", err)
 			return err
@@ -158,7 +159,7 @@ func ResetUserDeviceToken(appid int64, uid int64, device_token string, ng_device
 			log.Infof("reset ng token:%s device token:%s\n", token, ng_device_token)
 			return nil
 		}
-		_, err = conn.Do("HDEL", key, "ng_device_token", "ng_timestamp")
+		_, err = redis_store.Do("HDEL", key, "ng_device_token", "ng_timestamp")
 		if err != nil {
 			log.Info("hdel err:", err)
 			return err
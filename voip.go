@@ -19,18 +19,21 @@
 
 package main
 
+import "os"
 import "net"
 import "fmt"
 import "flag"
 import "time"
 import "runtime"
+import "crypto/tls"
 import "github.com/garyburd/redigo/redis"
 import log "github.com/golang/glog"
 
 
 var app_route *AppRoute
-var redis_pool *redis.Pool
 var tunnel *Tunnel
+var tunnel_auth_pool *WorkerPool
+var push_pool *WorkerPool
 var config *Config
 
 func init() {
@@ -43,14 +46,13 @@ func handle_client(conn *net.TCPConn) {
 }
 
 func Listen(f func(*net.TCPConn), port int) {
-	ip := net.ParseIP("0.0.0.0")
-	addr := net.TCPAddr{ip, port, ""}
-
-	listen, err := net.ListenTCP("tcp", &addr)
+	addr := fmt.Sprintf("0.0.0.0:%d", port)
+	listen, err := ListenTCP(addr)
 	if err != nil {
 		fmt.Println("初始化失败", err.Error())
 		return
 	}
+	AddListener(addr, listen)
 	for {
 		client, err := listen.AcceptTCP()
 		if err != nil {
@@ -64,49 +66,131 @@ func ListenClient() {
 	Listen(handle_client, config.port)
 }
 
-func NewRedisPool(server, password string) *redis.Pool {
+func new_redis_pool(dial func() (redis.Conn, error)) *redis.Pool {
 	return &redis.Pool{
-		MaxIdle:     100,
-		MaxActive:   500,
-		IdleTimeout: 480 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				return nil, err
-			}
-			if len(password) > 0 {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
-			return c, err
-		},
+		MaxIdle:     config.redis_max_idle,
+		MaxActive:   config.redis_max_active,
+		IdleTimeout: time.Duration(config.redis_idle_timeout) * time.Second,
+		Dial:        dial,
+	}
+}
+
+func NewRedisPool(server, password string, db int) *redis.Pool {
+	return new_redis_pool(func() (redis.Conn, error) {
+		return dial_redis(server, password, db)
+	})
+}
+
+func is_private_ip(ip net.IP) bool {
+	private := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+	for _, cidr := range private {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast()
 }
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	check_config := flag.Bool("check-config", false, "check config and exit")
+	print_config := flag.Bool("print-config", false, "print effective config and exit")
+	RegisterConfigFlags()
 	flag.Parse()
-	if len(flag.Args()) == 0 {
-		fmt.Println("usage: im config")
+
+	//配置文件可以省略, 只使用环境变量和命令行参数
+	cfg_path := os.Getenv(CONFIG_ENV_PREFIX + "CONFIG")
+	if len(flag.Args()) > 0 {
+		cfg_path = flag.Args()[0]
+	}
+
+	if *check_config || *print_config {
+		c, errs := load_cfg(cfg_path)
+		for _, err := range errs {
+			fmt.Println("config error:", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		if *print_config {
+			PrintConfig(c)
+		} else {
+			fmt.Println("config ok")
+		}
 		return
 	}
 
-	config = read_cfg(flag.Args()[0])
+	LoadInheritedFiles()
+	config = read_cfg(cfg_path)
+	SetConfig(config)
 	log.Infof("port:%d tunnel port:%d port v2:%d redis address:%s\n",
 		config.port, config.tunnel_port, config.tunnel_port_v2, config.redis_address)
+	for _, ip := range config.tunnel_advertised_ips {
+		if is_private_ip(ip) {
+			log.Warningf("advertised tunnel ip:%s is private", ip)
+		}
+	}
+	if len(config.tunnel_advertised_ips) == 0 {
+		log.Warning("tunnel_advertised_ips not set, advertise local address")
+	}
+	if config.legacy_appid != 0 {
+		log.Warningf("deprecated legacy protocol enabled appid:%d tunnel address:%s",
+			config.legacy_appid, config.legacy_tunnel_address)
+	}
 
 
-	redis_pool = NewRedisPool(config.redis_address, "")
+	redis_breaker = NewCircuitBreaker("redis", config.redis_breaker_failures,
+		time.Duration(config.redis_breaker_cooldown) * time.Second)
+	redis_store = NewBreakerStore(NewRedisStore(config), redis_breaker)
+	tunnel_auth_pool = NewWorkerPool("tunnel_auth", config.tunnel_auth_workers,
+		config.tunnel_auth_queue_size)
+	push_pool = NewWorkerPool("push", config.push_workers, config.push_queue_size)
+	if config.auth_cache_size > 0 {
+		auth_cache = NewAuthCache(config.auth_cache_size)
+		go auth_cache.ListenRevocation(config.auth_revoke_channel)
+	}
 
 	tunnel = NewTunnel()
+	RestoreHandoff()
+
+	if config.tunnel_tcp_port > 0 {
+		go tunnel.ListenStream(config.tunnel_tcp_port, nil)
+	}
+	if config.tunnel_tls_port > 0 {
+		cert, err := tls.LoadX509KeyPair(config.tunnel_tls_cert, config.tunnel_tls_key)
+		if err != nil {
+			log.Fatal("load tls cert err:", err)
+		}
+		tls_config := &tls.Config{Certificates:[]tls.Certificate{cert}}
+		go tunnel.ListenStream(config.tunnel_tls_port, tls_config)
+	}
+
+	relay_registry = NewRelayRegistry()
+	go relay_registry.Run()
+	if config.relay_id != "" {
+		go RelayHeartbeat(config.relay_id)
+	}
+
+	go ListenHTTP()
 
 //disable tcp
-	go tunnel.Run()
-	tunnel.RunV2()
+	if config.legacy_appid != 0 && len(config.legacy_tunnel_address) > 0 {
+		go tunnel.Run()
+	}
+	go tunnel.RunV2()
+	go tunnel.RunGC()
+	if config.turn_port > 0 {
+		turn_server = NewTURNServer(config.turn_realm, net.ParseIP(config.turn_relay_ip), tunnel.quotas)
+		go turn_server.Run()
+	}
 
 //enable tcp
 	//tunnel.Start()
-	//ListenClient()
+	if config.client_listen != 0 {
+		go ListenClient()
+	}
+
+	NotifyHandoffReady()
+	WaitSignal(cfg_path)
 }
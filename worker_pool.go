@@ -0,0 +1,52 @@
+/**
+ * Copyright (c) 2014-2015, GoBelieve     
+ * All rights reserved.
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package main
+
+//固定数量的协程处理任务, 队列满时立即失败而不是阻塞调用者
+type WorkerPool struct {
+	name  string
+	tasks chan func()
+}
+
+func NewWorkerPool(name string, workers int, queue_size int) *WorkerPool {
+	pool := new(WorkerPool)
+	pool.name = name
+	pool.tasks = make(chan func(), queue_size)
+	for i := 0; i < workers; i++ {
+		go pool.run()
+	}
+	return pool
+}
+
+func (pool *WorkerPool) run() {
+	for task := range pool.tasks {
+		task()
+	}
+}
+
+func (pool *WorkerPool) Submit(task func()) bool {
+	select {
+	case pool.tasks <- task:
+		return true
+	default:
+		worker_pool_stats.Add(pool.name+"_rejected", 1)
+		return false
+	}
+}